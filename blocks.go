@@ -0,0 +1,207 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+)
+
+// rawBlock is a block kept as decoded JSON. slack.Blocks cannot
+// round-trip some rich_text elements(lists, quotes, code blocks).
+type rawBlock map[string]interface{}
+
+func (b rawBlock) BlockType() slack.MessageBlockType {
+	t, _ := b["type"].(string)
+	return slack.MessageBlockType(t)
+}
+
+// rawMessageEvent has fields slackevents.MessageEvent does not parse.
+type rawMessageEvent struct {
+	Blocks  []rawBlock       `json:"blocks"`
+	Message *rawMessageEvent `json:"message"`
+}
+
+// sourceBlocks returns blocks of the message(or the edited message) in the event.
+func sourceBlocks(eventsAPIEvent slackevents.EventsAPIEvent) []rawBlock {
+	cbEvent, ok := eventsAPIEvent.Data.(*slackevents.EventsAPICallbackEvent)
+	if !ok || cbEvent.InnerEvent == nil {
+		return nil
+	}
+
+	var raw rawMessageEvent
+	if err := json.Unmarshal(*cbEvent.InnerEvent, &raw); err != nil {
+		return nil
+	}
+
+	if raw.Message != nil {
+		return raw.Message.Blocks
+	}
+	return raw.Blocks
+}
+
+// translateBlocks resolves mentions in blocks and prepends the link to the source message.
+func (agg *Aggregator) translateBlocks(ctx context.Context, blocks []rawBlock, src *slackevents.MessageEvent) ([]slack.Block, error) {
+	uri, label, err := agg.ChannelInfo.messageLinkParts(ctx, src)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve cnannel name(genLink):%w", err)
+	}
+
+	results := make([]slack.Block, 0, len(blocks)+1)
+	for i, block := range blocks {
+		translated, err := agg.translateBlockValue(ctx, map[string]interface{}(block))
+		if err != nil {
+			return nil, err
+		}
+		b := rawBlock(translated.(map[string]interface{}))
+
+		if i == 0 && !prependLinkElement(b, uri, label) {
+			results = append(results, mrkdwnSection(fmt.Sprintf("<%s|`%s`>", uri, label)))
+		}
+		results = append(results, b)
+	}
+
+	return results, nil
+}
+
+func mrkdwnSection(text string) rawBlock {
+	return rawBlock{
+		"type": "section",
+		"text": map[string]interface{}{"type": "mrkdwn", "text": text},
+	}
+}
+
+// prependLinkElement inserts the link at the head of the first rich_text_section.
+func prependLinkElement(block rawBlock, uri, label string) bool {
+	if block.BlockType() != slack.MBTRichText {
+		return false
+	}
+
+	elements, ok := block["elements"].([]interface{})
+	if !ok || len(elements) == 0 {
+		return false
+	}
+
+	section, ok := elements[0].(map[string]interface{})
+	if !ok || section["type"] != string(slack.RTESection) {
+		return false
+	}
+
+	children, _ := section["elements"].([]interface{})
+	section["elements"] = append([]interface{}{
+		map[string]interface{}{"type": "link", "url": uri, "text": label, "style": map[string]interface{}{"code": true}},
+		map[string]interface{}{"type": "text", "text": " "},
+	}, children...)
+
+	return true
+}
+
+// translateBlockValue walks decoded JSON and neutralizes mentions.
+func (agg *Aggregator) translateBlockValue(ctx context.Context, v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case []interface{}:
+		results := make([]interface{}, 0, len(value))
+		for _, elem := range value {
+			translated, err := agg.translateBlockValue(ctx, elem)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, translated)
+		}
+		return results, nil
+	case map[string]interface{}:
+		return agg.translateBlockElement(ctx, value)
+	}
+	return v, nil
+}
+
+func (agg *Aggregator) translateBlockElement(ctx context.Context, elem map[string]interface{}) (interface{}, error) {
+	switch elem["type"] {
+	case string(slack.RTSEUser):
+		uid, _ := elem["user_id"].(string)
+		name := uid
+		if prof, err := agg.UserInfo.GetUserProfile(ctx, uid); err == nil {
+			name = prof.Name
+		} else {
+			fmt.Fprintf(os.Stderr, "error replacing uids:%v\n", err)
+		}
+		return mentionTextElement(elem, "＠"+name), nil
+	case string(slack.RTSEUserGroup):
+		gid, _ := elem["usergroup_id"].(string)
+		return mentionTextElement(elem, "＠"+agg.userGroupHandle(ctx, gid, "")), nil
+	case string(slack.RTSEBroadcast):
+		r, _ := elem["range"].(string)
+		return mentionTextElement(elem, "@"+r), nil
+	case "mrkdwn":
+		if text, ok := elem["text"].(string); ok {
+			escaped, err := agg.escapeText(ctx, text)
+			if err != nil {
+				return nil, err
+			}
+			elem["text"] = escaped
+		}
+		return elem, nil
+	}
+
+	for k, v := range elem {
+		translated, err := agg.translateBlockValue(ctx, v)
+		if err != nil {
+			return nil, err
+		}
+		elem[k] = translated
+	}
+	return elem, nil
+}
+
+// mentionTextElement replaces a mention element with a text element which does not notify.
+func mentionTextElement(elem map[string]interface{}, text string) map[string]interface{} {
+	result := map[string]interface{}{"type": string(slack.RTSEText), "text": text}
+	if style, ok := elem["style"]; ok {
+		result["style"] = style
+	}
+	return result
+}
+
+// translateAttachments resolves mentions in attachments of the source message.
+func (agg *Aggregator) translateAttachments(ctx context.Context, attachments []slack.Attachment) ([]slack.Attachment, error) {
+	results := make([]slack.Attachment, 0, len(attachments))
+	for _, attachment := range attachments {
+		var err error
+		for _, text := range []*string{&attachment.Fallback, &attachment.Pretext, &attachment.Text} {
+			if *text, err = agg.escapeText(ctx, *text); err != nil {
+				return nil, err
+			}
+		}
+
+		fields := make([]slack.AttachmentField, 0, len(attachment.Fields))
+		for _, field := range attachment.Fields {
+			if field.Value, err = agg.escapeText(ctx, field.Value); err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+		}
+		attachment.Fields = fields
+
+		// slack.Blocks loses contents of rich_text blocks.
+		for _, block := range attachment.Blocks.BlockSet {
+			if block.BlockType() == slack.MBTRichText {
+				attachment.Blocks = slack.Blocks{}
+				break
+			}
+		}
+
+		results = append(results, attachment)
+	}
+	return results, nil
+}
+
+func (agg *Aggregator) escapeText(ctx context.Context, text string) (string, error) {
+	resolved, err := agg.UserInfo.ReplaceMentionUIDs(ctx, text)
+	if err != nil {
+		return "", err
+	}
+	return EscapeChannelCall(agg.resolveReferences(ctx, resolved)), nil
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranslateBlocks(t *testing.T) {
+	ui := CreateUserInfo(nil, nil, nil)
+	ui.name["U1"] = &UserProfile{Name: "alice"}
+	agg := &Aggregator{UserInfo: ui}
+
+	var block rawBlock
+	err := json.Unmarshal([]byte(`{"type":"rich_text","elements":[
+		{"type":"rich_text_list","style":"bullet","elements":[
+			{"type":"rich_text_section","elements":[
+				{"type":"user","user_id":"U1","style":{"bold":true}},
+				{"type":"broadcast","range":"here"}]}]}]}`), &block)
+	assert.Nil(t, err)
+
+	translated, err := agg.translateBlockValue(context.Background(), map[string]interface{}(block))
+	assert.Nil(t, err)
+
+	b, _ := json.Marshal(translated)
+	assert.JSONEq(t, `{"type":"rich_text","elements":[
+		{"type":"rich_text_list","style":"bullet","elements":[
+			{"type":"rich_text_section","elements":[
+				{"type":"text","text":"＠alice","style":{"bold":true}},
+				{"type":"text","text":"@here"}]}]}]}`, string(b))
+
+	// the link goes into the leading section only.
+	assert.False(t, prependLinkElement(rawBlock(translated.(map[string]interface{})), "https://example.com", "#general"))
+
+	section := rawBlock{"type": "rich_text", "elements": []interface{}{
+		map[string]interface{}{"type": "rich_text_section", "elements": []interface{}{}},
+	}}
+	assert.True(t, prependLinkElement(section, "https://example.com", "#general"))
+	b, _ = json.Marshal(section)
+	assert.JSONEq(t, `{"type":"rich_text","elements":[{"type":"rich_text_section","elements":[
+		{"type":"link","url":"https://example.com","text":"#general","style":{"code":true}},
+		{"type":"text","text":" "}]}]}`, string(b))
+}
@@ -15,11 +15,13 @@ import (
 )
 
 type ChannelInfo struct {
-	name   map[string]string
-	domain string
-	api    *slack.Client
-	mu     sync.Mutex
-	redis  *redis.Client
+	name map[string]string
+	// whether channels are private. kept in memory only.
+	private map[string]bool
+	domain  string
+	api     *slack.Client
+	mu      sync.Mutex
+	redis   *redis.Client
 }
 
 func CreateChanInfo(ctx context.Context, api *slack.Client, redis *redis.Client) (*ChannelInfo, error) {
@@ -55,6 +57,7 @@ func InitChanInfo(ctx context.Context, api *slack.Client) (*ChannelInfo, error)
 
 	for _, ch := range chans {
 		info.name[ch.ID] = ch.Name
+		info.setPrivate(ch.ID, ch.IsPrivate || ch.IsMpIM)
 	}
 	//api.Debugf("loaded %d channels\n", len(info.name))
 	fmt.Printf("loaded %d channels.\n", len(info.name))
@@ -64,7 +67,22 @@ func InitChanInfo(ctx context.Context, api *slack.Client) (*ChannelInfo, error)
 }
 
 func getChannelList(ctx context.Context, api *slack.Client) ([]slack.Channel, error) {
-	req := slack.GetConversationsParameters{ExcludeArchived: true}
+	chans, err := getConversations(ctx, api, "public_channel", "private_channel", "mpim")
+	if err == nil {
+		return chans, nil
+	}
+
+	// private channels need groups:read and mpim:read
+	var slackErr slack.SlackErrorResponse
+	if errors.As(err, &slackErr) && slackErr.Err == "missing_scope" {
+		fmt.Printf("cannot list private channels:%v\n", err)
+		return getConversations(ctx, api, "public_channel")
+	}
+	return nil, err
+}
+
+func getConversations(ctx context.Context, api *slack.Client, types ...string) ([]slack.Channel, error) {
+	req := slack.GetConversationsParameters{ExcludeArchived: true, Types: types}
 	var results []slack.Channel
 
 	for {
@@ -90,17 +108,31 @@ func getChannelList(ctx context.Context, api *slack.Client) ([]slack.Channel, er
 }
 
 func (info *ChannelInfo) GetMessageLink(ctx context.Context, ev *slackevents.MessageEvent) (string, error) {
+	uri, label, err := info.messageLinkParts(ctx, ev)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("<%s|`%s`>", uri, label), nil
+}
+
+// messageLinkParts returns URI and label of the link to the message.
+func (info *ChannelInfo) messageLinkParts(ctx context.Context, ev *slackevents.MessageEvent) (string, string, error) {
 	name, err := info.GetName(ctx, ev.Channel)
 	if err != nil {
-		return "", fmt.Errorf("cannot convert channel id:%w", err)
+		return "", "", fmt.Errorf("cannot convert channel id:%w", err)
+	}
+
+	marker := ""
+	if isPrivateChannelType(ev.ChannelType) {
+		marker = privateChannelMarker
 	}
 
 	if isMessageUri(ev) {
-		return fmt.Sprintf("<%s|`#%s`>", info.getMessageUri(ev), name), nil
+		return info.getMessageUri(ev), marker + "#" + name, nil
 	} else {
-		return fmt.Sprintf("<%s|`%%%s`>", info.getMessageUri(ev), name), nil
+		return info.getMessageUri(ev), marker + "%" + name, nil
 	}
-
 }
 
 func isMessageUri(ev *slackevents.MessageEvent) bool {
@@ -131,9 +163,46 @@ func (info *ChannelInfo) GetName(ctx context.Context, cid string) (string, error
 		return "", fmt.Errorf("err at conversations.info(cid=%s):%w", cid, err)
 	}
 
+	info.setPrivate(cid, cinfo.IsPrivate || cinfo.IsMpIM)
 	return info.setName(ctx, cid, cinfo.Name), nil
 }
 
+// isPrivate reports whether the channel is private. unknown channels are treated as private.
+func (info *ChannelInfo) isPrivate(ctx context.Context, cid string) bool {
+	var private, ok bool
+	func() {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		private, ok = info.private[cid]
+	}()
+
+	if ok {
+		return private
+	}
+	if info.api == nil {
+		return true
+	}
+
+	cinfo, err := info.api.GetConversationInfoContext(ctx, cid, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "err at conversations.info(cid=%s):%v\n", cid, err)
+		return true
+	}
+
+	private = cinfo.IsPrivate || cinfo.IsMpIM
+	info.setPrivate(cid, private)
+	return private
+}
+
+func (info *ChannelInfo) setPrivate(cid string, private bool) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if info.private == nil {
+		info.private = make(map[string]bool)
+	}
+	info.private[cid] = private
+}
+
 func (info *ChannelInfo) lookupName(ctx context.Context, cid string) (string, bool) {
 	name := ""
 	ok := false
@@ -180,7 +249,8 @@ func (info *ChannelInfo) setName(ctx context.Context, cid, cname string) string
 	return cname
 }
 
-func (info *ChannelInfo) UpdateName(ctx context.Context, chinfo slackevents.ChannelRenameInfo) {
+// UpdateName updates the channel name and returns the old name if known.
+func (info *ChannelInfo) UpdateName(ctx context.Context, chinfo slackevents.ChannelRenameInfo) (string, bool) {
 	old, ok := info.lookupName(ctx, chinfo.ID)
 	if ok {
 		fmt.Printf("rename channel(%s) %s -> %s\n", chinfo.ID, old, chinfo.Name)
@@ -188,8 +258,12 @@ func (info *ChannelInfo) UpdateName(ctx context.Context, chinfo slackevents.Chan
 		fmt.Printf("rename channel(%s) ??? -> %s\n", chinfo.ID, chinfo.Name)
 	}
 	info.setName(ctx, chinfo.ID, chinfo.Name)
+
+	return old, ok
 }
 
 func (info *ChannelInfo) HandleCreateEvent(ctx context.Context, chinfo slackevents.ChannelCreatedInfo) {
+	// channel_created is sent only for public channels.
+	info.setPrivate(chinfo.ID, false)
 	info.setName(ctx, chinfo.ID, chinfo.Name)
 }
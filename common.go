@@ -2,103 +2,128 @@ package common
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/slack-go/slack"
+	"github.com/walkure/aggrechans/mrkdwn"
 )
 
-func PostMessage(ctx context.Context, api *slack.Client, prof *UserProfile, blocks *[]slack.Block, disableUnfurlLink bool, msg string, channel string) error {
+// PostMessage posts a message and returns its timestamp.
+func PostMessage(ctx context.Context, api *slack.Client, prof *UserProfile, blocks *[]slack.Block, disableUnfurlLink bool, msg string, channel string, extra ...slack.MsgOption) (string, error) {
 
 	options := []slack.MsgOption{slack.MsgOptionText(msg, false),
-		slack.MsgOptionUsername(prof.Name),
+		slack.MsgOptionUsername(prof.Label()),
 		slack.MsgOptionIconURL(prof.Avatar)}
 
-	if blocks != nil && len(*blocks) > 1 {
-		options = append(options, slack.MsgOptionBlocks(*blocks...))
+	options = append(options, extra...)
+
+	if disableUnfurlLink {
+		options = append(options, slack.MsgOptionDisableLinkUnfurl())
 	}
 
+	if blocks != nil && len(*blocks) > 0 {
+		_, ts, err := postMessageWithRetry(ctx, api, channel, append(options, slack.MsgOptionBlocks(*blocks...))...)
+		if !isInvalidBlocks(err) {
+			return ts, err
+		}
+		// fall back to the text if blocks are rejected.
+		fmt.Fprintf(os.Stderr, "blocks rejected. post text only:%v\n", err)
+	}
+
+	_, ts, err := postMessageWithRetry(ctx, api, channel, options...)
+	return ts, err
+}
+
+// UpdateMessage replaces a message posted by PostMessage.
+func UpdateMessage(ctx context.Context, api *slack.Client, blocks *[]slack.Block, disableUnfurlLink bool, msg string, channel string, ts string, extra ...slack.MsgOption) error {
+
+	options := []slack.MsgOption{slack.MsgOptionText(msg, false)}
+
+	options = append(options, extra...)
+
 	if disableUnfurlLink {
 		options = append(options, slack.MsgOptionDisableLinkUnfurl())
 	}
 
-	_, _, err := postMessageWithRetry(ctx, api, channel, options...)
-	return err
+	if blocks != nil && len(*blocks) > 0 {
+		err := updateMessageWithRetry(ctx, api, channel, ts, append(options, slack.MsgOptionBlocks(*blocks...))...)
+		if !isInvalidBlocks(err) {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "blocks rejected. update text only:%v\n", err)
+	}
+
+	// clear blocks of the previous version.
+	return updateMessageWithRetry(ctx, api, channel, ts, append(options, slack.MsgOptionBlocks([]slack.Block{}...))...)
+}
+
+func isInvalidBlocks(err error) bool {
+	var slackErr slack.SlackErrorResponse
+	return errors.As(err, &slackErr) && slackErr.Err == "invalid_blocks"
 }
 
 func postMessageWithRetry(ctx context.Context, api *slack.Client, channelID string, options ...slack.MsgOption) (string, string, error) {
-	for {
-		respChannel, respTimestamp, err := api.PostMessageContext(ctx, channelID, options...)
-		if err == nil {
-			return respChannel, respTimestamp, nil
-		} else if rateLimitedError, ok := err.(*slack.RateLimitedError); ok {
-			select {
-			case <-ctx.Done():
-				return "", "", ctx.Err()
-			case <-time.After(rateLimitedError.RetryAfter):
-				continue
-			}
-		} else {
-			return "", "", err
-		}
+	var respChannel, respTimestamp string
+	err := withRetry(ctx, func() error {
+		var err error
+		respChannel, respTimestamp, err = api.PostMessageContext(ctx, channelID, options...)
+		return err
+	})
+	if err != nil {
+		return "", "", err
 	}
+	return respChannel, respTimestamp, nil
+}
+
+func updateMessageWithRetry(ctx context.Context, api *slack.Client, channelID, timestamp string, options ...slack.MsgOption) error {
+	return withRetry(ctx, func() error {
+		_, _, _, err := api.UpdateMessageContext(ctx, channelID, timestamp, options...)
+		return err
+	})
+}
+
+func deleteMessageWithRetry(ctx context.Context, api *slack.Client, channelID, timestamp string) error {
+	return withRetry(ctx, func() error {
+		_, _, err := api.DeleteMessageContext(ctx, channelID, timestamp)
+		return err
+	})
 }
 
+// EscapeChannelCall neutralizes broadcast mentions such as <!channel>.
 func EscapeChannelCall(orig string) string {
-	origRune := []rune(orig)
-
-	sb := strings.Builder{}
-	tag := 0
-	for i := 0; i < len(origRune); i++ {
-		if origRune[i] == '<' {
-			tag = 1
-			sb.WriteRune('<')
-		} else if origRune[i] == '!' && tag == 1 {
-			sbb := strings.Builder{}
-			tagClosed := false
-			for j := i; j < len(origRune); j++ {
-				if origRune[j] == '>' {
-					tagClosed = true
-					break
-				} else {
-					sbb.WriteRune(origRune[j])
-				}
-			}
-			if !tagClosed {
-				sb.WriteRune('！')
-				tag = 0
-				continue
-			}
-			sbbs := sbb.String()
-
-			if strings.HasPrefix(sbbs, "!subteam^") {
-				sb.WriteRune('＠')
-				sep := strings.Index(sbbs, "|")
-				i += (sep + 1)
-			} else if sbbs == "!channel" {
-				sb.WriteString("@channel")
-				i += 7
-			} else if sbbs == "!everyone" {
-				sb.WriteString("@everyone")
-				i += 8
-			} else if sbbs == "!here" {
-				sb.WriteString("@here")
-				i += 4
-			} else if sbbs == "!group" {
-				sb.WriteString("@group")
-				i += 5
-			} else {
-				sb.WriteRune('！')
-			}
-			tag = 0
-		} else {
-			sb.WriteRune(origRune[i])
-			tag = 0
+	return rewriteText(orig, func(tok mrkdwn.Token) (string, bool) {
+		switch tok.Kind {
+		case mrkdwn.SpecialMention:
+			return "<@" + tok.Value + ">", true
+		case mrkdwn.UserGroupRef:
+			return "<＠" + fallbackLabel(strings.TrimPrefix(tok.Label, "@"), tok.Value) + ">", true
+		case mrkdwn.Command:
+			return "<！" + strings.TrimPrefix(tok.Raw, "<!"), true
+		case mrkdwn.Text:
+			// unclosed
+			return strings.ReplaceAll(tok.Raw, "<!", "<！"), true
 		}
-	}
-	return sb.String()
+		return "", false
+	})
+}
+
+// rewriteText replaces tokens of the mrkdwn text by f. tokens are kept as is if f returns false.
+// inline code and code blocks are never rewritten.
+func rewriteText(s string, f func(tok mrkdwn.Token) (string, bool)) string {
+	return mrkdwn.Rewrite(s, func(tok mrkdwn.Token) string {
+		if tok.Kind == mrkdwn.Code || tok.Kind == mrkdwn.CodeBlock {
+			return tok.Raw
+		}
+
+		if rewritten, ok := f(tok); ok {
+			return rewritten
+		}
+		return tok.Raw
+	})
 }
 
 func LoadRedisConfig() *redis.Options {
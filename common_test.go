@@ -0,0 +1,20 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscapeChannelCall(t *testing.T) {
+	assert.Equal(t, "<@here> <@channel> <＠eng> <！date^1|Feb 18> <！here", EscapeChannelCall("<!here> <!channel|channel> <!subteam^S1|@eng> <!date^1|Feb 18> <!here"))
+	assert.Equal(t, "<https://example.com|a|b> <@U1>", EscapeChannelCall("<https://example.com|a|b> <@U1>"))
+}
+
+func TestEscapeChannelCallInCode(t *testing.T) {
+	orig := "<!here> see `<!here> <@U1>` and\n```\n$ echo <!channel> <!subteam^S1|@eng>\n```\n<!channel>"
+	assert.Equal(t, "<@here> see `<!here> <@U1>` and\n```\n$ echo <!channel> <!subteam^S1|@eng>\n```\n<@channel>", EscapeChannelCall(orig))
+
+	// unclosed backtick is not code.
+	assert.Equal(t, "`<@here>", EscapeChannelCall("`<!here>"))
+}
@@ -0,0 +1,152 @@
+package common
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	redisDeadLetterKey = "aggrechans:deadletter:v1"
+	// older dead letters are dropped
+	deadLetterMax = 1000
+	// hex digits of dead letter IDs
+	deadLetterIDLen = 12
+)
+
+// DeadLetter is an outbox message which could not be delivered.
+type DeadLetter struct {
+	Message  *OutboxMessage `json:"message"`
+	Error    string         `json:"error"`
+	FailedAt time.Time      `json:"failed_at"`
+	// identifies the entry while others are added or removed. derived from the stored form.
+	ID string `json:"-"`
+
+	// stored form to remove the entry
+	raw string
+}
+
+// DeadLetterStore keeps failed messages to inspect and replay them later.
+type DeadLetterStore interface {
+	Add(ctx context.Context, msg *OutboxMessage, cause error) error
+	// List returns dead letters, the newest first.
+	List(ctx context.Context) ([]*DeadLetter, error)
+	Remove(ctx context.Context, dl *DeadLetter) error
+}
+
+// NewDeadLetterStore returns a store backed by a Redis list, or memory if redis is nil.
+func NewDeadLetterStore(redis *redis.Client) DeadLetterStore {
+	if redis != nil {
+		return &redisDeadLetterStore{redis: redis}
+	}
+	return &memoryDeadLetterStore{}
+}
+
+func newDeadLetter(msg *OutboxMessage, cause error) (*DeadLetter, error) {
+	dl := &DeadLetter{Message: msg, Error: cause.Error(), FailedAt: time.Now()}
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal dead letter:%w", err)
+	}
+	dl.setRaw(string(data))
+	return dl, nil
+}
+
+func (dl *DeadLetter) setRaw(raw string) {
+	sum := sha1.Sum([]byte(raw))
+	dl.raw, dl.ID = raw, hex.EncodeToString(sum[:])[:deadLetterIDLen]
+}
+
+func (dl *DeadLetter) String() string {
+	return fmt.Sprintf("%s %s:%s", dl.FailedAt.Format(time.RFC3339), dl.Message, dl.Error)
+}
+
+type redisDeadLetterStore struct {
+	redis *redis.Client
+}
+
+func (s *redisDeadLetterStore) Add(ctx context.Context, msg *OutboxMessage, cause error) error {
+	dl, err := newDeadLetter(msg, cause)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, redisDeadLetterKey, dl.raw)
+		pipe.LTrim(ctx, redisDeadLetterKey, 0, deadLetterMax-1)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot save dead letter:%w", err)
+	}
+	return nil
+}
+
+func (s *redisDeadLetterStore) List(ctx context.Context) ([]*DeadLetter, error) {
+	values, err := s.redis.LRange(ctx, redisDeadLetterKey, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("cannot load dead letters:%w", err)
+	}
+
+	dls := make([]*DeadLetter, 0, len(values))
+	for _, v := range values {
+		dl := &DeadLetter{}
+		dl.setRaw(v)
+		if err := json.Unmarshal([]byte(v), dl); err != nil || dl.Message == nil {
+			// kept to be purged
+			dl.Message = &OutboxMessage{}
+			dl.Error = fmt.Sprintf("broken dead letter:%v", err)
+		}
+		dls = append(dls, dl)
+	}
+	return dls, nil
+}
+
+func (s *redisDeadLetterStore) Remove(ctx context.Context, dl *DeadLetter) error {
+	return s.redis.LRem(ctx, redisDeadLetterKey, 1, dl.raw).Err()
+}
+
+// memoryDeadLetterStore loses dead letters on restart.
+type memoryDeadLetterStore struct {
+	dls []*DeadLetter
+	mu  sync.Mutex
+}
+
+func (s *memoryDeadLetterStore) Add(ctx context.Context, msg *OutboxMessage, cause error) error {
+	dl, err := newDeadLetter(msg, cause)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dls = append([]*DeadLetter{dl}, s.dls...)
+	if len(s.dls) > deadLetterMax {
+		s.dls = s.dls[:deadLetterMax]
+	}
+	return nil
+}
+
+func (s *memoryDeadLetterStore) List(ctx context.Context) ([]*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*DeadLetter{}, s.dls...), nil
+}
+
+func (s *memoryDeadLetterStore) Remove(ctx context.Context, dl *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, v := range s.dls {
+		if v.raw == dl.raw {
+			s.dls = append(s.dls[:i], s.dls[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
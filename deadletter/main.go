@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	common "github.com/walkure/aggrechans"
+)
+
+// inspect and replay messages which could not be delivered.
+//
+//	deadletter list
+//	deadletter replay [-all] [id...]
+//	deadletter purge [-all] [id...]
+func main() {
+	all := flag.Bool("all", false, "apply to all dead letters")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: deadletter list | replay [-all] [id...] | purge [-all] [id...]")
+		flag.PrintDefaults()
+	}
+	if len(os.Args) < 2 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+	cmd := os.Args[1]
+	flag.CommandLine.Parse(os.Args[2:])
+
+	opt := common.LoadRedisConfig()
+	if opt == nil {
+		fmt.Fprintln(os.Stderr, "cannot load redis config.")
+		os.Exit(-1)
+	}
+	rdb := redis.NewClient(opt)
+	store := common.NewDeadLetterStore(rdb)
+
+	ctx := context.Background()
+	dls, err := store.List(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(-1)
+	}
+
+	switch cmd {
+	case "list":
+		list(dls)
+		return
+	case "replay", "purge":
+	default:
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	targets, err := selectDeadLetters(dls, *all, flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(-1)
+	}
+
+	// the running service picks up the replayed messages from its outbox.
+	outbox := common.NewOutbox(rdb)
+	for _, dl := range targets {
+		if cmd == "replay" {
+			if err := outbox.Push(ctx, dl.Message); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot replay %s:%v\n", dl.Message, err)
+				continue
+			}
+		}
+		if err := store.Remove(ctx, dl); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot remove %s:%v\n", dl.Message, err)
+			continue
+		}
+		fmt.Printf("%s %s\n", cmd, dl.Message)
+	}
+}
+
+func list(dls []*common.DeadLetter) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFAILED_AT\tOP\tSOURCE\tDESTINATION\tERROR")
+	for _, dl := range dls {
+		msg := dl.Message
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s:%s\t%s\t%s\n",
+			dl.ID, dl.FailedAt.Format(time.RFC3339), msg.Op, msg.Channel, msg.TimeStamp, msg.Dst, dl.Error)
+	}
+	w.Flush()
+}
+
+// selectDeadLetters returns dead letters of the IDs shown by list.
+func selectDeadLetters(dls []*common.DeadLetter, all bool, args []string) ([]*common.DeadLetter, error) {
+	if all {
+		return dls, nil
+	}
+	if len(args) == 0 {
+		return nil, errors.New("id or -all required")
+	}
+
+	byID := make(map[string]*common.DeadLetter, len(dls))
+	for _, dl := range dls {
+		byID[dl.ID] = dl
+	}
+
+	targets := make([]*common.DeadLetter, 0, len(args))
+	for _, arg := range args {
+		dl, ok := byID[arg]
+		if !ok {
+			return nil, fmt.Errorf("unknown dead letter:%s", arg)
+		}
+		targets = append(targets, dl)
+	}
+	return targets, nil
+}
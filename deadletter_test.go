@@ -0,0 +1,34 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryDeadLetterStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewDeadLetterStore(nil)
+
+	assert.Nil(t, s.Add(ctx, &OutboxMessage{Dst: "CDST", TimeStamp: "1"}, errors.New("not_in_channel")))
+	assert.Nil(t, s.Add(ctx, &OutboxMessage{Dst: "CDST", TimeStamp: "2"}, errors.New("channel_not_found")))
+
+	dls, err := s.List(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(dls))
+	assert.Equal(t, "2", dls[0].Message.TimeStamp)
+	assert.Equal(t, "not_in_channel", dls[1].Error)
+	assert.Equal(t, 12, len(dls[0].ID))
+	assert.NotEqual(t, dls[0].ID, dls[1].ID)
+	id := dls[1].ID
+
+	assert.Nil(t, s.Remove(ctx, dls[0]))
+	dls, err = s.List(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(dls))
+	assert.Equal(t, "1", dls[0].Message.TimeStamp)
+	// IDs do not shift when others are removed
+	assert.Equal(t, id, dls[0].ID)
+}
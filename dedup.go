@@ -0,0 +1,103 @@
+package common
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/slack-go/slack/slackevents"
+)
+
+const (
+	redisDedupPrefix = "aggrechans:dedup:v1:"
+	// slack retries callbacks for a few minutes.
+	dedupTTL = 10 * time.Minute
+	// keys remembered in memory
+	dedupMemorySize = 10000
+)
+
+// Deduplicator detects events delivered more than once.
+type Deduplicator interface {
+	// Seen marks the keys and reports whether any of them was marked before.
+	Seen(ctx context.Context, keys ...string) bool
+}
+
+// NewDeduplicator returns a deduplicator shared among replicas by Redis, or in memory if redis is nil.
+func NewDeduplicator(redis *redis.Client) Deduplicator {
+	mem := newMemoryDeduplicator(dedupMemorySize)
+	if redis != nil {
+		return &redisDeduplicator{redis: redis, fallback: mem}
+	}
+	return mem
+}
+
+// eventKeys returns keys identifying the event.
+// the same message may come with different event IDs when both bot and user events are subscribed.
+func eventKeys(eventsAPIEvent slackevents.EventsAPIEvent) []string {
+	var keys []string
+	if cb, ok := eventsAPIEvent.Data.(*slackevents.EventsAPICallbackEvent); ok && cb.EventID != "" {
+		keys = append(keys, "event:"+cb.EventID)
+	}
+	if ev, ok := eventsAPIEvent.InnerEvent.Data.(*slackevents.MessageEvent); ok && ev.TimeStamp != "" {
+		keys = append(keys, fmt.Sprintf("message:%s:%s:%s", ev.Channel, ev.TimeStamp, ev.SubType))
+	}
+	return keys
+}
+
+// redisDeduplicator marks keys by SETNX with a short TTL.
+type redisDeduplicator struct {
+	redis *redis.Client
+	// used while Redis is unavailable
+	fallback *memoryDeduplicator
+}
+
+func (d *redisDeduplicator) Seen(ctx context.Context, keys ...string) bool {
+	seen := false
+	for _, key := range keys {
+		ok, err := d.redis.SetNX(ctx, redisDedupPrefix+key, 1, dedupTTL).Result()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot mark event(%s):%v\n", key, err)
+			return d.fallback.Seen(ctx, keys...) || seen
+		}
+		seen = seen || !ok
+	}
+	return seen
+}
+
+// memoryDeduplicator forgets the least recently seen keys.
+type memoryDeduplicator struct {
+	size  int
+	order *list.List
+	keys  map[string]*list.Element
+	mu    sync.Mutex
+}
+
+func newMemoryDeduplicator(size int) *memoryDeduplicator {
+	return &memoryDeduplicator{size: size, order: list.New(), keys: make(map[string]*list.Element)}
+}
+
+func (d *memoryDeduplicator) Seen(ctx context.Context, keys ...string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	seen := false
+	for _, key := range keys {
+		if e, ok := d.keys[key]; ok {
+			d.order.MoveToFront(e)
+			seen = true
+			continue
+		}
+
+		d.keys[key] = d.order.PushFront(key)
+		if d.order.Len() > d.size {
+			oldest := d.order.Back()
+			d.order.Remove(oldest)
+			delete(d.keys, oldest.Value.(string))
+		}
+	}
+	return seen
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/slack-go/slack/slackevents"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventKeys(t *testing.T) {
+	ev := slackevents.EventsAPIEvent{
+		Data: &slackevents.EventsAPICallbackEvent{EventID: "Ev1"},
+		InnerEvent: slackevents.EventsAPIInnerEvent{
+			Data: &slackevents.MessageEvent{Channel: "C1", TimeStamp: "1.0", SubType: "message_changed"},
+		},
+	}
+	assert.Equal(t, []string{"event:Ev1", "message:C1:1.0:message_changed"}, eventKeys(ev))
+
+	ev.InnerEvent.Data = &slackevents.ChannelRenameEvent{}
+	assert.Equal(t, []string{"event:Ev1"}, eventKeys(ev))
+}
+
+func TestMemoryDeduplicator(t *testing.T) {
+	ctx := context.Background()
+	d := newMemoryDeduplicator(2)
+
+	assert.False(t, d.Seen(ctx, "event:Ev1", "message:C1:1.0:"))
+	// redelivered with another event ID
+	assert.True(t, d.Seen(ctx, "event:Ev2", "message:C1:1.0:"))
+	assert.False(t, d.Seen(ctx, "event:Ev3"))
+
+	// Ev1 is evicted
+	assert.False(t, d.Seen(ctx, "event:Ev1"))
+	assert.True(t, d.Seen(ctx, "event:Ev3"))
+}
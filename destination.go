@@ -0,0 +1,80 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// delete mirrored copies of deleted messages
+	onDeleteDelete = "delete"
+	// replace mirrored copies of deleted messages with a placeholder
+	onDeletePlaceholder = "placeholder"
+	// leave mirrored copies as they are
+	onDeleteKeep = "keep"
+)
+
+// DestinationOptions is how messages are mirrored into a destination channel.
+type DestinationOptions struct {
+	// delete(default), placeholder or keep
+	OnDelete string `json:"on_delete,omitempty" yaml:"on_delete,omitempty"`
+	// post thread replies under the mirrored parent message
+	Threads bool `json:"threads,omitempty" yaml:"threads,omitempty"`
+	// post periodic summaries instead of each message
+	Digest *DigestOptions `json:"digest,omitempty" yaml:"digest,omitempty"`
+	// post a notice when a renamed channel is routed to or away from the destination
+	RenameNotice bool `json:"rename_notice,omitempty" yaml:"rename_notice,omitempty"`
+}
+
+// destinationInfo holds options per destination channel ID.
+type destinationInfo map[string]DestinationOptions
+
+func (d destinationInfo) get(chanId string) DestinationOptions {
+	opts := d[chanId]
+	if opts.OnDelete == "" {
+		opts.OnDelete = onDeleteDelete
+	}
+	if opts.Digest != nil && opts.Digest.Minutes == 0 {
+		digest := *opts.Digest
+		digest.Minutes = digestDefaultMinutes
+		opts.Digest = &digest
+	}
+	return opts
+}
+
+func (d destinationInfo) validate() error {
+	for chanId, opts := range d {
+		switch opts.OnDelete {
+		case "", onDeleteDelete, onDeletePlaceholder, onDeleteKeep:
+		default:
+			return fmt.Errorf("destination[%s]:unknown on_delete:%s", chanId, opts.OnDelete)
+		}
+		if d := opts.Digest; d != nil && (d.Minutes < 0 || d.Messages < 0 || d.Minutes == 0 && d.Messages == 0) {
+			return fmt.Errorf("destination[%s]:digest needs positive minutes or messages", chanId)
+		}
+	}
+	return nil
+}
+
+func (d destinationInfo) String() string {
+	chanIds := make([]string, 0, len(d))
+	for chanId := range d {
+		chanIds = append(chanIds, chanId)
+	}
+	sort.Strings(chanIds)
+
+	var lines []string
+	for _, chanId := range chanIds {
+		opts := d.get(chanId)
+		line := fmt.Sprintf("destination[%s]:on_delete=%s,threads=%t", chanId, opts.OnDelete, opts.Threads)
+		if opts.Digest != nil {
+			line += ",digest=" + opts.Digest.String()
+		}
+		if opts.RenameNotice {
+			line += ",rename_notice=true"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,394 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/slack-go/slack/slackevents"
+	"github.com/walkure/aggrechans/mrkdwn"
+)
+
+const (
+	// set of destination channels which have pending digest entries
+	redisDigestDestsKey = "aggrechans:digest:v1:dests"
+	redisDigestPrefix   = "aggrechans:digest:v1:"
+	// unix time of the last digest per destination channel
+	redisDigestFlushedPrefix = "aggrechans:digest:v1:flushed:"
+	// pending digests are checked at this interval
+	digestTick = time.Minute
+	// digests are posted every hour if only the count is given
+	digestDefaultMinutes = 60
+	// text of a message in digests is cut around this
+	digestEntryTextMax = 200
+	// digests longer than this are split into several posts
+	digestPostMax  = 3500
+	digestUsername = "digest"
+)
+
+// DigestOptions batches messages into a periodic summary.
+type DigestOptions struct {
+	// post a digest every N minutes
+	Minutes int `json:"minutes,omitempty" yaml:"minutes,omitempty"`
+	// post a digest when M messages are pending
+	Messages int `json:"messages,omitempty" yaml:"messages,omitempty"`
+}
+
+func (o *DigestOptions) String() string {
+	return fmt.Sprintf("%dmin/%dmsgs", o.Minutes, o.Messages)
+}
+
+// DigestEntry is a message waiting for the digest.
+type DigestEntry struct {
+	Channel string `json:"channel"`
+	// label of the source channel shown as the heading
+	ChannelLabel string `json:"channel_label"`
+	TimeStamp    string `json:"ts"`
+	URI          string `json:"uri"`
+	Username     string `json:"username"`
+	Text         string `json:"text"`
+}
+
+// DigestStore buffers digest entries per destination channel.
+type DigestStore interface {
+	// Add appends the entry and returns the number of pending entries of the destination.
+	// the first entry of a new destination starts its period.
+	Add(ctx context.Context, dst string, entry *DigestEntry) (int, error)
+	// Take removes and returns pending entries of the destination, and records the time.
+	Take(ctx context.Context, dst string) ([]*DigestEntry, error)
+	// FlushedAt returns when entries of the destination were taken last.
+	FlushedAt(ctx context.Context, dst string) (time.Time, error)
+	// Dests returns destination channels which have pending entries.
+	Dests(ctx context.Context) ([]string, error)
+	// Remove drops the pending entry of the source message.
+	Remove(ctx context.Context, dst, channel, ts string) error
+}
+
+// NewDigestStore returns a store backed by Redis lists, or memory if redis is nil.
+func NewDigestStore(redis *redis.Client) DigestStore {
+	if redis != nil {
+		return &redisDigestStore{redis: redis}
+	}
+	return &memoryDigestStore{entries: make(map[string][]*DigestEntry), flushed: make(map[string]time.Time)}
+}
+
+// addDigest buffers the message and posts the digest if enough messages are pending.
+func (agg *Aggregator) addDigest(ctx context.Context, dst string, src *slackevents.MessageEvent, prof *UserProfile, body string) error {
+	uri, label, err := agg.ChannelInfo.messageLinkParts(ctx, src)
+	if err != nil {
+		return fmt.Errorf("cannot resolve channel name(digest):%w", err)
+	}
+
+	entry := &DigestEntry{
+		Channel:      src.Channel,
+		ChannelLabel: label,
+		TimeStamp:    src.TimeStamp,
+		URI:          uri,
+		Username:     prof.Label(),
+		Text:         digestText(body),
+	}
+	n, err := agg.Digests.Add(ctx, dst, entry)
+	if err != nil {
+		return err
+	}
+
+	if max := agg.Dispatcher.Destination(dst).Digest.Messages; max > 0 && n >= max {
+		return agg.flushDigest(ctx, dst)
+	}
+	return nil
+}
+
+// flushDigest posts pending messages of the destination.
+func (agg *Aggregator) flushDigest(ctx context.Context, dst string) error {
+	entries, err := agg.Digests.Take(ctx, dst)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	for _, text := range formatDigest(entries) {
+		msg := &OutboxMessage{Op: OutboxOpDigest, Dst: dst, Username: digestUsername, Text: text}
+		if err := agg.enqueue(ctx, msg); err != nil {
+			return fmt.Errorf("cannot post digest(dst=%s):%w", dst, err)
+		}
+	}
+	return nil
+}
+
+// digestLoop posts digests N minutes after the last ones.
+func (agg *Aggregator) digestLoop(ctx context.Context) {
+	ticker := time.NewTicker(digestTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			dsts, err := agg.Digests.Dests(ctx)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot load digest destinations:%v\n", err)
+				continue
+			}
+			for _, dst := range dsts {
+				last, err := agg.Digests.FlushedAt(ctx, dst)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "cannot load the last digest time(dst=%s):%v\n", dst, err)
+					continue
+				}
+				if !isDigestDue(agg.Dispatcher.Destination(dst).Digest, last, now) {
+					continue
+				}
+				if err := agg.flushDigest(ctx, dst); err != nil {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+				}
+			}
+		}
+	}
+}
+
+// removeDigest drops the deleted message from pending digests.
+// digests already posted are not changed.
+func (agg *Aggregator) removeDigest(ctx context.Context, channel, ts string) error {
+	dsts, err := agg.Digests.Dests(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot load digest destinations:%w", err)
+	}
+
+	for _, dst := range dsts {
+		if err := agg.Digests.Remove(ctx, dst, channel, ts); err != nil {
+			return fmt.Errorf("cannot remove digest entry(dst=%s):%w", dst, err)
+		}
+	}
+	return nil
+}
+
+// digestText makes the text short and in a line.
+func digestText(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+
+	// cut at the token boundary not to break links and mentions.
+	sb := strings.Builder{}
+	for _, tok := range mrkdwn.Tokenize(text) {
+		rest := digestEntryTextMax - utf8.RuneCountInString(sb.String())
+		if rest <= 0 {
+			sb.WriteString("…")
+			break
+		}
+		if tok.Kind == mrkdwn.Text && utf8.RuneCountInString(tok.Raw) > rest {
+			sb.WriteString(string([]rune(tok.Raw)[:rest]) + "…")
+			break
+		}
+		sb.WriteString(tok.Raw)
+	}
+	return sb.String()
+}
+
+// formatDigest renders entries grouped by source channel in order of appearance.
+// the result is split into posts not too long.
+func formatDigest(entries []*DigestEntry) []string {
+	var order []string
+	groups := make(map[string][]*DigestEntry)
+	for _, e := range entries {
+		if _, ok := groups[e.Channel]; !ok {
+			order = append(order, e.Channel)
+		}
+		groups[e.Channel] = append(groups[e.Channel], e)
+	}
+
+	var lines []string
+	for _, cid := range order {
+		group := groups[cid]
+		lines = append(lines, fmt.Sprintf("*%s* (%d)", group[0].ChannelLabel, len(group)))
+		for _, e := range group {
+			lines = append(lines, fmt.Sprintf("• %s *%s*: %s", digestTime(e), e.Username, e.Text))
+		}
+	}
+
+	var posts []string
+	post := ""
+	for _, line := range lines {
+		if post != "" && len(post)+len(line)+1 > digestPostMax {
+			posts = append(posts, post)
+			post = ""
+		}
+		if post != "" {
+			post += "\n"
+		}
+		post += line
+	}
+	if post != "" {
+		posts = append(posts, post)
+	}
+	return posts
+}
+
+// digestTime shows the time in the reader's timezone linked to the message.
+func digestTime(e *DigestEntry) string {
+	sec, err := strconv.ParseFloat(e.TimeStamp, 64)
+	if err != nil {
+		return fmt.Sprintf("<%s|%s>", e.URI, e.TimeStamp)
+	}
+	t := time.Unix(int64(sec), 0).UTC()
+	return fmt.Sprintf("<!date^%d^{time}^%s|%s UTC>", t.Unix(), e.URI, t.Format("15:04"))
+}
+
+// isDigestDue reports whether N minutes have passed since the last digest.
+// the elapsed time is rounded to the tick not to be late by a tick.
+func isDigestDue(opts *DigestOptions, last, now time.Time) bool {
+	if opts == nil {
+		// digest mode turned off. post the rest.
+		return true
+	}
+	return now.Sub(last)+digestTick/2 >= time.Duration(opts.Minutes)*time.Minute
+}
+
+type redisDigestStore struct {
+	redis *redis.Client
+}
+
+func (s *redisDigestStore) Add(ctx context.Context, dst string, entry *DigestEntry) (int, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0, fmt.Errorf("cannot marshal digest entry:%w", err)
+	}
+
+	var n *redis.IntCmd
+	_, err = s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, redisDigestDestsKey, dst)
+		pipe.SetNX(ctx, redisDigestFlushedPrefix+dst, time.Now().Unix(), 0)
+		n = pipe.RPush(ctx, redisDigestPrefix+dst, data)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("cannot save digest entry:%w", err)
+	}
+	return int(n.Val()), nil
+}
+
+func (s *redisDigestStore) Take(ctx context.Context, dst string) ([]*DigestEntry, error) {
+	key := redisDigestPrefix + dst
+
+	// taken at once so that only one replica posts the digest.
+	var values *redis.StringSliceCmd
+	_, err := s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		values = pipe.LRange(ctx, key, 0, -1)
+		pipe.Del(ctx, key)
+		pipe.SRem(ctx, redisDigestDestsKey, dst)
+		pipe.Set(ctx, redisDigestFlushedPrefix+dst, time.Now().Unix(), 0)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot take digest entries:%w", err)
+	}
+
+	entries := make([]*DigestEntry, 0, len(values.Val()))
+	for _, v := range values.Val() {
+		e := &DigestEntry{}
+		if err := json.Unmarshal([]byte(v), e); err != nil {
+			fmt.Fprintf(os.Stderr, "broken digest entry(dst=%s):%v\n", dst, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (s *redisDigestStore) FlushedAt(ctx context.Context, dst string) (time.Time, error) {
+	sec, err := s.redis.Get(ctx, redisDigestFlushedPrefix+dst).Int64()
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
+
+func (s *redisDigestStore) Dests(ctx context.Context) ([]string, error) {
+	return s.redis.SMembers(ctx, redisDigestDestsKey).Result()
+}
+
+func (s *redisDigestStore) Remove(ctx context.Context, dst, channel, ts string) error {
+	key := redisDigestPrefix + dst
+	values, err := s.redis.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		e := &DigestEntry{}
+		if err := json.Unmarshal([]byte(v), e); err != nil || e.Channel != channel || e.TimeStamp != ts {
+			continue
+		}
+		if err := s.redis.LRem(ctx, key, 0, v).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memoryDigestStore loses pending entries on restart.
+type memoryDigestStore struct {
+	entries map[string][]*DigestEntry
+	flushed map[string]time.Time
+	mu      sync.Mutex
+}
+
+func (s *memoryDigestStore) Add(ctx context.Context, dst string, entry *DigestEntry) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.flushed[dst]; !ok {
+		s.flushed[dst] = time.Now()
+	}
+	s.entries[dst] = append(s.entries[dst], entry)
+	return len(s.entries[dst]), nil
+}
+
+func (s *memoryDigestStore) Take(ctx context.Context, dst string) ([]*DigestEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := s.entries[dst]
+	delete(s.entries, dst)
+	s.flushed[dst] = time.Now()
+	return entries, nil
+}
+
+func (s *memoryDigestStore) FlushedAt(ctx context.Context, dst string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushed[dst], nil
+}
+
+func (s *memoryDigestStore) Dests(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dsts := make([]string, 0, len(s.entries))
+	for dst := range s.entries {
+		dsts = append(dsts, dst)
+	}
+	return dsts, nil
+}
+
+func (s *memoryDigestStore) Remove(ctx context.Context, dst, channel, ts string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := s.entries[dst][:0]
+	for _, e := range s.entries[dst] {
+		if e.Channel != channel || e.TimeStamp != ts {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 {
+		delete(s.entries, dst)
+	} else {
+		s.entries[dst] = entries
+	}
+	return nil
+}
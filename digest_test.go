@@ -0,0 +1,95 @@
+package common
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDigestText(t *testing.T) {
+	assert.Equal(t, "hello world", digestText("hello\n\nworld"))
+
+	long := strings.Repeat("a", 198) + "<https://example.com|link> tail"
+	assert.Equal(t, strings.Repeat("a", 198)+"<https://example.com|link>…", digestText(long))
+
+	long = strings.Repeat("あ", 250)
+	assert.Equal(t, strings.Repeat("あ", 200)+"…", digestText(long))
+}
+
+func TestFormatDigest(t *testing.T) {
+	entries := []*DigestEntry{
+		{Channel: "C1", ChannelLabel: "#general", TimeStamp: "1635735600.000100", URI: "https://x/1", Username: "alice", Text: "hi"},
+		{Channel: "C2", ChannelLabel: "#random", TimeStamp: "1635735660.000100", URI: "https://x/2", Username: "bob", Text: "yo"},
+		{Channel: "C1", ChannelLabel: "#general", TimeStamp: "1635735720.000100", URI: "https://x/3", Username: "carol", Text: "hey"},
+	}
+
+	assert.Equal(t, []string{"*#general* (2)\n" +
+		"• <!date^1635735600^{time}^https://x/1|03:00 UTC> *alice*: hi\n" +
+		"• <!date^1635735720^{time}^https://x/3|03:02 UTC> *carol*: hey\n" +
+		"*#random* (1)\n" +
+		"• <!date^1635735660^{time}^https://x/2|03:01 UTC> *bob*: yo"}, formatDigest(entries))
+
+	var many []*DigestEntry
+	for i := 0; i < 50; i++ {
+		many = append(many, &DigestEntry{Channel: "C1", ChannelLabel: "#general", TimeStamp: "1", Username: "alice", Text: strings.Repeat("a", 200)})
+	}
+	posts := formatDigest(many)
+	assert.True(t, len(posts) > 1)
+	for _, post := range posts {
+		assert.True(t, len(post) <= digestPostMax, len(post))
+	}
+}
+
+func TestIsDigestDue(t *testing.T) {
+	opts := &DigestOptions{Minutes: 15}
+	last := time.Date(2021, 11, 1, 12, 15, 30, 0, time.UTC)
+	assert.False(t, isDigestDue(opts, last, time.Date(2021, 11, 1, 12, 29, 29, 0, time.UTC)))
+	// a tick slightly before the period ends
+	assert.True(t, isDigestDue(opts, last, time.Date(2021, 11, 1, 12, 30, 29, 0, time.UTC)))
+	// ticks missed while down
+	assert.True(t, isDigestDue(opts, last, time.Date(2021, 11, 1, 13, 2, 0, 0, time.UTC)))
+	assert.True(t, isDigestDue(nil, last, time.Date(2021, 11, 1, 12, 16, 0, 0, time.UTC)))
+}
+
+func TestMemoryDigestStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewDigestStore(nil)
+
+	last, err := s.FlushedAt(ctx, "CDST")
+	assert.Nil(t, err)
+	assert.True(t, last.IsZero())
+
+	n, err := s.Add(ctx, "CDST", &DigestEntry{TimeStamp: "1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	started, err := s.FlushedAt(ctx, "CDST")
+	assert.Nil(t, err)
+	assert.False(t, started.IsZero())
+	n, err = s.Add(ctx, "CDST", &DigestEntry{TimeStamp: "2"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	_, err = s.Add(ctx, "CDST", &DigestEntry{Channel: "CSRC", TimeStamp: "3"})
+	assert.Nil(t, err)
+	assert.Nil(t, s.Remove(ctx, "CDST", "CSRC", "3"))
+	assert.Nil(t, s.Remove(ctx, "COTHER", "CSRC", "3"))
+
+	dsts, err := s.Dests(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"CDST"}, dsts)
+
+	entries, err := s.Take(ctx, "CDST")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "2", entries[1].TimeStamp)
+	last, err = s.FlushedAt(ctx, "CDST")
+	assert.Nil(t, err)
+	assert.False(t, last.Before(started))
+
+	entries, err = s.Take(ctx, "CDST")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+}
@@ -0,0 +1,190 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// routeCondition is a dispatch rule condition other than the channel name.
+type routeCondition interface {
+	match(rc *RouteContext) bool
+	String() string
+}
+
+// channelIdCondition matches messages in one of the channels.
+// unlike channel name rules, it is not affected by renaming channels.
+type channelIdCondition struct {
+	cids []string
+}
+
+// userCondition matches messages posted by one of the users.
+type userCondition struct {
+	uids []string
+}
+
+// userGroupCondition matches messages posted by a member of one of the user groups.
+type userGroupCondition struct {
+	gids []string
+}
+
+// externalCondition matches messages posted by external users.
+type externalCondition struct{}
+
+// keywordCondition matches messages containing one of the keywords(case-insensitive).
+type keywordCondition struct {
+	keywords []string
+}
+
+// textCondition matches the message text by a regexp.
+type textCondition struct {
+	re *regexp.Regexp
+}
+
+// profileCondition matches a field of the author's profile.
+type profileCondition struct {
+	field string
+	re    *regexp.Regexp
+}
+
+func (c *externalCondition) match(rc *RouteContext) bool {
+	return rc.Profile != nil && rc.Profile.External
+}
+
+func (c *externalCondition) String() string {
+	return "external"
+}
+
+func (c *channelIdCondition) match(rc *RouteContext) bool {
+	for _, cid := range c.cids {
+		if cid == rc.ChannelID {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *channelIdCondition) String() string {
+	return fmt.Sprintf("channel[%s]", strings.Join(c.cids, ","))
+}
+
+func (c *userCondition) match(rc *RouteContext) bool {
+	for _, uid := range c.uids {
+		if uid == rc.UserID {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *userCondition) String() string {
+	return fmt.Sprintf("user[%s]", strings.Join(c.uids, ","))
+}
+
+func (c *userGroupCondition) match(rc *RouteContext) bool {
+	for _, gid := range c.gids {
+		if rc.InUserGroup(gid) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *userGroupCondition) String() string {
+	return fmt.Sprintf("usergroup[%s]", strings.Join(c.gids, ","))
+}
+
+func (c *profileCondition) match(rc *RouteContext) bool {
+	if rc.Profile == nil {
+		return false
+	}
+	value, _ := rc.Profile.field(c.field)
+	return c.re.MatchString(value)
+}
+
+func (c *profileCondition) String() string {
+	return fmt.Sprintf("profile.%s[%s]", c.field, c.re.String())
+}
+
+func (c *keywordCondition) match(rc *RouteContext) bool {
+	text := strings.ToLower(rc.Text)
+	for _, keyword := range c.keywords {
+		if strings.Contains(text, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *keywordCondition) String() string {
+	return fmt.Sprintf("keyword[%s]", strings.Join(c.keywords, ","))
+}
+
+func (c *textCondition) match(rc *RouteContext) bool {
+	return c.re.MatchString(rc.Text)
+}
+
+func (c *textCondition) String() string {
+	return fmt.Sprintf("text[%s]", c.re.String())
+}
+
+func parseRouteConditions(v *dispatchRuleInfo) ([]routeCondition, error) {
+	var conds []routeCondition
+
+	if len(v.ChannelIds) > 0 {
+		conds = append(conds, &channelIdCondition{cids: v.ChannelIds})
+	}
+
+	if len(v.Users) > 0 {
+		conds = append(conds, &userCondition{uids: v.Users})
+	}
+
+	if len(v.UserGroups) > 0 {
+		conds = append(conds, &userGroupCondition{gids: v.UserGroups})
+	}
+
+	if v.External {
+		conds = append(conds, &externalCondition{})
+	}
+
+	// sort fields to keep the order of conditions stable.
+	fields := make([]string, 0, len(v.Profile))
+	for field := range v.Profile {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		if _, ok := (&UserProfile{}).field(field); !ok {
+			return nil, fmt.Errorf("unknown profile field[%s]", field)
+		}
+		re, err := regexp.Compile(v.Profile[field])
+		if err != nil {
+			return nil, fmt.Errorf("invalid profile regex[%s]:%w", v.Profile[field], err)
+		}
+		conds = append(conds, &profileCondition{field: field, re: re})
+	}
+
+	if len(v.Keywords) > 0 {
+		keywords := make([]string, 0, len(v.Keywords))
+		for _, keyword := range v.Keywords {
+			if keyword == "" {
+				return nil, errors.New("empty keyword")
+			}
+			keywords = append(keywords, strings.ToLower(keyword))
+		}
+		conds = append(conds, &keywordCondition{keywords: keywords})
+	}
+
+	if v.Text != "" {
+		re, err := regexp.Compile(v.Text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid text regex[%s]:%w", v.Text, err)
+		}
+		conds = append(conds, &textCondition{re: re})
+	}
+
+	return conds, nil
+}
@@ -0,0 +1,190 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// interval to check whether the config file is modified.
+const configWatchInterval = 10 * time.Second
+
+// reloadableDispatcher swaps the underlying dispatcher when rules are reloaded.
+type reloadableDispatcher struct {
+	current ChannelDispatcher
+	mu      sync.RWMutex
+}
+
+func (d *reloadableDispatcher) Dispatch(rc *RouteContext) []string {
+	return d.get().Dispatch(rc)
+}
+
+func (d *reloadableDispatcher) Explain(rc *RouteContext) []string {
+	return d.get().Explain(rc)
+}
+
+func (d *reloadableDispatcher) Destination(chanId string) DestinationOptions {
+	return d.get().Destination(chanId)
+}
+
+func (d *reloadableDispatcher) AllowsPrivate(chanId string) bool {
+	return d.get().AllowsPrivate(chanId)
+}
+
+func (d *reloadableDispatcher) Rules() string {
+	return d.get().Rules()
+}
+
+func (d *reloadableDispatcher) get() ChannelDispatcher {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.current
+}
+
+func (d *reloadableDispatcher) set(cd ChannelDispatcher) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.current = cd
+}
+
+// fileDispatcher loads rules from a YAML or JSON file and reloads them
+// when the file is modified or SIGHUP is received.
+type fileDispatcher struct {
+	reloadableDispatcher
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+func newFileDispatcher(path string) (*fileDispatcher, error) {
+	d := &fileDispatcher{path: path}
+	if err := d.reload(); err != nil {
+		return nil, fmt.Errorf("cannot load %s:%w", path, err)
+	}
+
+	go d.watch()
+
+	return d, nil
+}
+
+// reload replaces rules only if the new config is valid.
+func (d *fileDispatcher) reload() error {
+	stat, err := os.Stat(d.path)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadDispatchConfigFile(d.path)
+	if err != nil {
+		return err
+	}
+
+	cd, err := cfg.newDispatcher()
+	if err != nil {
+		return err
+	}
+
+	d.set(cd)
+	d.modTime = stat.ModTime()
+	d.size = stat.Size()
+
+	return nil
+}
+
+func (d *fileDispatcher) modified() bool {
+	stat, err := os.Stat(d.path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot stat %s:%v\n", d.path, err)
+		return false
+	}
+	return !stat.ModTime().Equal(d.modTime) || stat.Size() != d.size
+}
+
+func (d *fileDispatcher) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			fmt.Printf("SIGHUP received. reload %s\n", d.path)
+		case <-ticker.C:
+			if !d.modified() {
+				continue
+			}
+			fmt.Printf("%s modified. reload\n", d.path)
+		}
+
+		if err := d.reload(); err != nil {
+			fmt.Fprintf(os.Stderr, "reload failed. keep the last rules:%v\n", err)
+			continue
+		}
+		fmt.Printf("dispatch rules reloaded.\n%s\n", d.Rules())
+	}
+}
+
+// loadDispatchConfigFile reads a config file. JSON is used if the extension is .json,
+// otherwise YAML. the file is either a dispatchConfig or rules only(same as DISPATCH_CHANNEL).
+func loadDispatchConfigFile(path string) (*dispatchConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDispatchConfig(data, strings.ToLower(filepath.Ext(path)) == ".json")
+}
+
+func parseDispatchConfig(data []byte, isJson bool) (*dispatchConfig, error) {
+	cfg := &dispatchConfig{}
+
+	if isJson {
+		trimmed := bytes.TrimSpace(data)
+		var target interface{} = cfg
+		if len(trimmed) > 0 && trimmed[0] == '[' {
+			target = &cfg.Rules
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(target); err != nil {
+			return nil, fmt.Errorf("JSON unmarshal error:%w", err)
+		}
+		return cfg, nil
+	}
+
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, fmt.Errorf("YAML unmarshal error:%w", err)
+	}
+
+	if len(node.Content) == 0 {
+		return nil, errors.New("empty config")
+	}
+
+	var target interface{} = cfg
+	if node.Content[0].Kind == yaml.SequenceNode {
+		target = &cfg.Rules
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(target); err != nil {
+		return nil, fmt.Errorf("YAML unmarshal error:%w", err)
+	}
+
+	return cfg, nil
+}
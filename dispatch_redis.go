@@ -0,0 +1,114 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// dispatch rules(JSON, same format as AGGRECHANS_CONFIG) shared by replicas.
+	// the suffix is the version of the stored format.
+	dispatchRulesRedisKey = "aggrechans:dispatch:v1"
+	// publish anything to this channel after updating the rules.
+	dispatchRulesRedisChannel = "aggrechans:dispatch:v1:updated"
+	// reload periodically in case of missing notifications.
+	dispatchRulesPollInterval = time.Minute
+)
+
+// redisDispatcher uses rules stored in Redis, or fallback if Redis holds none.
+type redisDispatcher struct {
+	reloadableDispatcher
+	redis    *redis.Client
+	fallback ChannelDispatcher
+}
+
+// NewSharedDispatcher loads dispatch rules from Redis and follows their updates.
+// rules loaded by NewDispatcher are used while Redis holds no rules.
+func NewSharedDispatcher(ctx context.Context, rdb *redis.Client) (ChannelDispatcher, error) {
+	fallback, err := NewDispatcher()
+	if err != nil {
+		if !errors.Is(err, errNoDispatchInfo) {
+			return nil, err
+		}
+		fallback = nil
+	}
+
+	d := &redisDispatcher{redis: rdb, fallback: fallback}
+	if err := d.reload(ctx); err != nil {
+		if fallback == nil {
+			return nil, fmt.Errorf("cannot load dispatch rules from redis:%w", err)
+		}
+		fmt.Fprintf(os.Stderr, "cannot load dispatch rules from redis. use environment variables:%v\n", err)
+		d.set(fallback)
+	}
+
+	go d.watch(ctx)
+
+	return d, nil
+}
+
+// reload replaces rules only if rules in Redis are valid.
+func (d *redisDispatcher) reload(ctx context.Context) error {
+	data, err := d.redis.Get(ctx, dispatchRulesRedisKey).Bytes()
+	if errors.Is(err, redis.Nil) {
+		if d.fallback == nil {
+			return errNoDispatchInfo
+		}
+		d.set(d.fallback)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cfg, err := parseDispatchConfig(data, true)
+	if err != nil {
+		return err
+	}
+
+	cd, err := cfg.newDispatcher()
+	if err != nil {
+		return err
+	}
+
+	d.set(cd)
+	return nil
+}
+
+func (d *redisDispatcher) watch(ctx context.Context) {
+	pubsub := d.redis.Subscribe(ctx, dispatchRulesRedisChannel)
+	defer pubsub.Close()
+
+	notified := pubsub.Channel()
+
+	ticker := time.NewTicker(dispatchRulesPollInterval)
+	defer ticker.Stop()
+
+	last := d.Rules()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-notified:
+			if !ok {
+				return
+			}
+		case <-ticker.C:
+		}
+
+		if err := d.reload(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "reload failed. keep the last rules:%v\n", err)
+			continue
+		}
+
+		if rules := d.Rules(); rules != last {
+			fmt.Printf("dispatch rules reloaded.\n%s\n", rules)
+			last = rules
+		}
+	}
+}
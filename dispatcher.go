@@ -5,119 +5,624 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"sort"
 	"strings"
 )
 
 type ChannelDispatcher interface {
-	Dispatch(chanName string) string
+	// Dispatch returns destination channel IDs without duplicates.
+	Dispatch(rc *RouteContext) []string
+	// Explain returns the rules which decided the result of Dispatch.
+	Explain(rc *RouteContext) []string
+	// Destination returns options of the destination channel.
+	Destination(chanId string) DestinationOptions
+	// AllowsPrivate reports whether the private channel is in the allow-list.
+	AllowsPrivate(chanId string) bool
 	Rules() string
 }
 
+// RouteContext is the message information which dispatch rules match against.
+type RouteContext struct {
+	ChannelID   string
+	ChannelName string
+	UserID      string
+	Profile     *UserProfile
+	SubType     string
+	// posted in a private channel or a multi-party DM
+	Private bool
+	// message text whose user mentions are resolved by UserInfo.ReplaceMentionUIDs
+	Text string
+
+	// reports whether the user belongs to the user group.
+	inUserGroup func(gid string) bool
+}
+
+func (rc *RouteContext) InUserGroup(gid string) bool {
+	if rc.inUserGroup == nil || rc.UserID == "" {
+		return false
+	}
+	return rc.inUserGroup(gid)
+}
+
 type simpleDispatcher struct {
 	chanId string
+	// exclude rules only
+	excludes     []dispatchRule
+	destinations destinationInfo
+	private      privateChannels
+}
+
+// dispatchRule is one entry of DISPATCH_CHANNEL. rules are evaluated in
+// the order of mappedDispatcher.rules and the first match wins
+// unless the rule is marked as `continue`.
+type dispatchRule struct {
+	// channel name matcher. empty kind matches every channel.
+	kind     string
+	pattern  string
+	chanId   string
+	priority int
+	// matched channel is not sent anywhere.
+	exclude bool
+	// evaluate following rules after match to fan out.
+	fallthru bool
+	// messages of external users matching the rule are not sent anywhere.
+	excludeExternal bool
+	// compiled pattern of regex and glob rules
+	re *regexp.Regexp
+	// additional conditions. all of them must match.
+	conds []routeCondition
 }
 
 type mappedDispatcher struct {
-	suffixMap map[string]string
-	prefixMap map[string]string
+	rules []dispatchRule
+	// destination used when no rule matches
+	defaultChanId string
+	destinations  destinationInfo
+	private       privateChannels
+}
+
+// explanation of messages dropped by the private channel allow-list
+const privateNotAllowedRule = "private channel not allowed"
+
+const (
+	// evaluate rules in the order written in DISPATCH_CHANNEL
+	dispatchOrderDeclared = "declared"
+	// evaluate rules from the longest pattern
+	dispatchOrderLongest = "longest"
+)
+
+func (d simpleDispatcher) Dispatch(rc *RouteContext) []string {
+	dests, _ := d.evaluate(rc)
+	return dests
+}
+
+func (d simpleDispatcher) Explain(rc *RouteContext) []string {
+	_, matched := d.evaluate(rc)
+	return matched
+}
+
+func (d simpleDispatcher) evaluate(rc *RouteContext) ([]string, []string) {
+	if !d.private.allows(rc) {
+		return nil, []string{privateNotAllowedRule}
+	}
+
+	for i := range d.excludes {
+		if d.excludes[i].match(rc) {
+			return nil, []string{d.excludes[i].String()}
+		}
+	}
+	return []string{d.chanId}, []string{fmt.Sprintf("send every message to:%s", d.chanId)}
 }
 
-func (d simpleDispatcher) Dispatch(chanName string) string {
-	return d.chanId
+func (d simpleDispatcher) Destination(chanId string) DestinationOptions {
+	return d.destinations.get(chanId)
+}
+
+func (d simpleDispatcher) AllowsPrivate(chanId string) bool {
+	return containsDestination(d.private, chanId)
 }
 
 func (d simpleDispatcher) Rules() string {
-	return fmt.Sprintf("send every message to:%s", d.chanId)
+	var rules []string
+
+	for i := range d.excludes {
+		rules = append(rules, d.excludes[i].String())
+	}
+	rules = append(rules, fmt.Sprintf("send every message to:%s", d.chanId))
+
+	if len(d.destinations) > 0 {
+		rules = append(rules, d.destinations.String())
+	}
+
+	if len(d.private) > 0 {
+		rules = append(rules, d.private.String())
+	}
+
+	return strings.Join(rules, "\n")
 }
 
-func (d *mappedDispatcher) Dispatch(chanName string) string {
-	for k, v := range d.prefixMap {
-		if strings.HasPrefix(chanName, k) {
-			return v
+func (r *dispatchRule) match(rc *RouteContext) bool {
+	if !r.matchChannel(rc.ChannelName) {
+		return false
+	}
+
+	for _, cond := range r.conds {
+		if !cond.match(rc) {
+			return false
 		}
 	}
+	return true
+}
+
+func (r *dispatchRule) matchChannel(chanName string) bool {
+	switch r.kind {
+	case "":
+		return true
+	case "prefix":
+		return strings.HasPrefix(chanName, r.pattern)
+	case "suffix":
+		return strings.HasSuffix(chanName, r.pattern)
+	case "regex", "glob":
+		return r.re.MatchString(chanName)
+	}
+	return false
+}
 
-	for k, v := range d.suffixMap {
-		if strings.HasSuffix(chanName, k) {
-			return v
+func (r *dispatchRule) String() string {
+	var conds []string
+	if r.kind != "" {
+		conds = append(conds, fmt.Sprintf("%s[%s]", r.kind, r.pattern))
+	}
+	for _, cond := range r.conds {
+		conds = append(conds, cond.String())
+	}
+
+	dest := fmt.Sprintf("[%s]", r.chanId)
+	if r.exclude {
+		dest = "(exclude)"
+	}
+
+	if r.excludeExternal {
+		dest += "(exclude external)"
+	}
+
+	if r.fallthru {
+		dest += "(continue)"
+	}
+
+	if r.priority != 0 {
+		return fmt.Sprintf("%s->%s(priority:%d)", strings.Join(conds, "&"), dest, r.priority)
+	}
+	return fmt.Sprintf("%s->%s", strings.Join(conds, "&"), dest)
+}
+
+func (d *mappedDispatcher) Dispatch(rc *RouteContext) []string {
+	dests, _ := d.evaluate(rc)
+	return dests
+}
+
+func (d *mappedDispatcher) Explain(rc *RouteContext) []string {
+	_, matched := d.evaluate(rc)
+	return matched
+}
+
+// evaluate returns destinations and matched rules.
+func (d *mappedDispatcher) evaluate(rc *RouteContext) ([]string, []string) {
+	if !d.private.allows(rc) {
+		return nil, []string{privateNotAllowedRule}
+	}
+
+	var dests, matched []string
+	for i := range d.rules {
+		if !d.rules[i].match(rc) {
+			continue
+		}
+
+		matched = append(matched, d.rules[i].String())
+		if d.rules[i].exclude {
+			return nil, matched
+		}
+
+		// dropped rather than falling through to later rules and the default.
+		if d.rules[i].excludeExternal && (&externalCondition{}).match(rc) {
+			return nil, matched
+		}
+
+		dests = appendDestination(dests, d.rules[i].chanId)
+		if !d.rules[i].fallthru {
+			return dests, matched
 		}
 	}
 
-	return ""
+	if len(dests) == 0 && d.defaultChanId != "" {
+		return []string{d.defaultChanId}, []string{fmt.Sprintf("default->[%s]", d.defaultChanId)}
+	}
+
+	return dests, matched
+}
+
+func appendDestination(dests []string, chanId string) []string {
+	if containsDestination(dests, chanId) {
+		return dests
+	}
+	return append(dests, chanId)
+}
+
+func appendDestinations(dests []string, chanIds ...string) []string {
+	for _, v := range chanIds {
+		dests = appendDestination(dests, v)
+	}
+	return dests
+}
+
+func containsDestination(dests []string, chanId string) bool {
+	for _, v := range dests {
+		if v == chanId {
+			return true
+		}
+	}
+	return false
 }
 
 func (d *mappedDispatcher) Rules() string {
 	var rules []string
 
-	for k, v := range d.prefixMap {
-		rules = append(rules, fmt.Sprintf("prefix[%s]->[%s]", k, v))
+	for i := range d.rules {
+		rules = append(rules, d.rules[i].String())
+	}
+
+	if d.defaultChanId != "" {
+		rules = append(rules, fmt.Sprintf("default->[%s]", d.defaultChanId))
+	}
+
+	if len(d.destinations) > 0 {
+		rules = append(rules, d.destinations.String())
 	}
 
-	for k, v := range d.suffixMap {
-		rules = append(rules, fmt.Sprintf("suffix[%s]->[%s]", k, v))
+	if len(d.private) > 0 {
+		rules = append(rules, d.private.String())
 	}
 
 	return strings.Join(rules, "\n")
 }
 
+func (d *mappedDispatcher) Destination(chanId string) DestinationOptions {
+	return d.destinations.get(chanId)
+}
+
+func (d *mappedDispatcher) AllowsPrivate(chanId string) bool {
+	return containsDestination(d.private, chanId)
+}
+
+func (d *mappedDispatcher) hasDestination() bool {
+	for i := range d.rules {
+		if !d.rules[i].exclude {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	errNoDispatchChannel = errors.New("DISPATCH_CHANNEL not found")
+	errNoDispatchInfo    = errors.New("no dispatch info found")
+)
+
+// NewDispatcher loads dispatch rules from the file specified by AGGRECHANS_CONFIG,
+// or DISPATCH_CHANNEL and AGGREGATE_CHANNEL_ID.
 func NewDispatcher() (ChannelDispatcher, error) {
 
-	md, err := newMapDispatcher()
-	if md != nil {
-		return md, nil
+	if path := os.Getenv("AGGRECHANS_CONFIG"); path != "" {
+		return newFileDispatcher(path)
 	}
 
-	if err != nil {
-		fmt.Printf("Dispatcher disabled.:%+v\n", err)
+	cfg, err := loadEnvDispatchConfig()
+	if err == nil {
+		d, err := cfg.newDispatcher()
+		if err != nil {
+			return nil, fmt.Errorf("invalid DISPATCH_CHANNEL:%w", err)
+		}
+		return d, nil
+	}
+
+	if !errors.Is(err, errNoDispatchChannel) {
+		return nil, fmt.Errorf("invalid DISPATCH_CHANNEL:%w", err)
 	}
+	fmt.Printf("Dispatcher disabled.:%+v\n", err)
 
-	aggChan := os.Getenv("AGGREGATE_CHANNEL_ID")
-	if aggChan != "" {
-		return simpleDispatcher{chanId: aggChan}, nil
+	if cfg.Default != "" {
+		return simpleDispatcher{chanId: cfg.Default, private: cfg.PrivateChannels}, nil
 	}
 
-	return nil, errors.New("no dispatch info found")
+	return nil, errNoDispatchInfo
 
 }
 
-type dispatchInfo []struct {
-	ChannelId string `json:"cid"`
-	Prefix    string `json:"prefix,omitempty"`
-	Suffix    string `json:"suffix,omitempty"`
+// dispatchConfig is the whole dispatch settings.
+type dispatchConfig struct {
+	// same as DISPATCH_ORDER
+	Order string `json:"order,omitempty" yaml:"order,omitempty"`
+	// same as AGGREGATE_CHANNEL_ID
+	Default string       `json:"default,omitempty" yaml:"default,omitempty"`
+	Rules   dispatchInfo `json:"rules" yaml:"rules"`
+	// options per destination channel ID
+	Destinations destinationInfo `json:"destinations,omitempty" yaml:"destinations,omitempty"`
+	// private channel IDs allowed to be forwarded. same as PRIVATE_CHANNEL_IDS
+	PrivateChannels privateChannels `json:"private_channels,omitempty" yaml:"private_channels,omitempty"`
 }
 
-func newMapDispatcher() (*mappedDispatcher, error) {
-	var result dispatchInfo
+type dispatchInfo []dispatchRuleInfo
+
+type dispatchRuleInfo struct {
+	ChannelId string `json:"cid" yaml:"cid"`
+	Prefix    string `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Suffix    string `json:"suffix,omitempty" yaml:"suffix,omitempty"`
+	Regex     string `json:"regex,omitempty" yaml:"regex,omitempty"`
+	Glob      string `json:"glob,omitempty" yaml:"glob,omitempty"`
+	Priority  int    `json:"priority,omitempty" yaml:"priority,omitempty"`
+	Exclude   bool   `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+	Continue  bool   `json:"continue,omitempty" yaml:"continue,omitempty"`
+
+	// matches channel IDs
+	ChannelIds []string `json:"channel_ids,omitempty" yaml:"channel_ids,omitempty"`
+
+	// conditions about the message author
+	Users      []string          `json:"users,omitempty" yaml:"users,omitempty"`
+	UserGroups []string          `json:"usergroups,omitempty" yaml:"usergroups,omitempty"`
+	Profile    map[string]string `json:"profile,omitempty" yaml:"profile,omitempty"`
+	// matches messages of Slack Connect users and users of other organizations
+	External bool `json:"external,omitempty" yaml:"external,omitempty"`
+	// drop messages of external users matching the rule
+	ExcludeExternal bool `json:"exclude_external,omitempty" yaml:"exclude_external,omitempty"`
+
+	// conditions about the message text
+	Keywords []string `json:"keywords,omitempty" yaml:"keywords,omitempty"`
+	Text     string   `json:"text,omitempty" yaml:"text,omitempty"`
+}
+
+// loadEnvDispatchConfig loads DISPATCH_CHANNEL, DISPATCH_ORDER, AGGREGATE_CHANNEL_ID and PRIVATE_CHANNEL_IDS.
+// returned config is not nil even if error occurs.
+func loadEnvDispatchConfig() (*dispatchConfig, error) {
+	cfg := &dispatchConfig{
+		Order:           os.Getenv("DISPATCH_ORDER"),
+		Default:         os.Getenv("AGGREGATE_CHANNEL_ID"),
+		PrivateChannels: loadEnvPrivateChannels(),
+	}
+
 	dispatchJson := os.Getenv("DISPATCH_CHANNEL")
 	if dispatchJson == "" {
-		return nil, errors.New("DISPATCH_CHANNEL not found")
+		return cfg, errNoDispatchChannel
+	}
+
+	// either rules only or the same format as AGGRECHANS_CONFIG
+	var target interface{} = &cfg.Rules
+	if strings.HasPrefix(strings.TrimSpace(dispatchJson), "{") {
+		target = cfg
+	}
+
+	// unknown keys have been ignored. warn them to find typos without breaking existing deployments.
+	dec := json.NewDecoder(strings.NewReader(dispatchJson))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(target); err != nil && strings.HasPrefix(err.Error(), "json: unknown field") {
+		fmt.Fprintf(os.Stderr, "[WARN] DISPATCH_CHANNEL:%v\n", err)
 	}
 
-	if err := json.Unmarshal([]byte(dispatchJson), &result); err != nil {
+	if err := json.Unmarshal([]byte(dispatchJson), target); err != nil {
 		if err, ok := err.(*json.SyntaxError); ok {
-			return nil, fmt.Errorf("JSON Syntax error:%w", err)
+			return cfg, fmt.Errorf("JSON Syntax error:%w", err)
 		}
-		return nil, fmt.Errorf("JSON unmarshal error:%w", err)
+		return cfg, fmt.Errorf("JSON unmarshal error:%w", err)
 	}
 
-	md := mappedDispatcher{prefixMap: map[string]string{}, suffixMap: map[string]string{}}
-	for _, v := range result {
-		if v.ChannelId == "" {
-			continue
+	return cfg, nil
+}
+
+func newMapDispatcher() (*mappedDispatcher, error) {
+	cfg, err := loadEnvDispatchConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg.newMapDispatcher()
+}
+
+func (cfg *dispatchConfig) newDispatcher() (ChannelDispatcher, error) {
+	if err := cfg.Destinations.validate(); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Rules) == 0 && cfg.Default != "" {
+		return simpleDispatcher{chanId: cfg.Default, destinations: cfg.Destinations, private: cfg.PrivateChannels}, nil
+	}
+
+	md, err := cfg.newMapDispatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if md.hasDestination() {
+		return md, nil
+	}
+
+	// only exclude rules are written.
+	if cfg.Default != "" {
+		return simpleDispatcher{chanId: cfg.Default, excludes: md.rules, destinations: cfg.Destinations, private: cfg.PrivateChannels}, nil
+	}
+	return nil, errors.New("no dispatch rules found(only exclude rules)")
+}
+
+func (cfg *dispatchConfig) newMapDispatcher() (*mappedDispatcher, error) {
+	md := mappedDispatcher{defaultChanId: cfg.Default, destinations: cfg.Destinations, private: cfg.PrivateChannels}
+	for i, v := range cfg.Rules {
+		if v.ChannelId == "" && !v.Exclude {
+			return nil, fmt.Errorf("rule #%d:cid not specified", i)
+		}
+
+		if v.ChannelId != "" && v.Exclude {
+			return nil, fmt.Errorf("rule #%d:exclude rule cannot have cid", i)
+		}
+
+		if v.Continue && v.Exclude {
+			return nil, fmt.Errorf("rule #%d:exclude rule cannot continue", i)
+		}
+
+		if v.ExcludeExternal && v.Exclude {
+			return nil, fmt.Errorf("rule #%d:exclude rule cannot have exclude_external(use external)", i)
+		}
+
+		conds, err := parseRouteConditions(&v)
+		if err != nil {
+			return nil, fmt.Errorf("rule #%d:%w", i, err)
+		}
+
+		base := dispatchRule{chanId: v.ChannelId, priority: v.Priority, exclude: v.Exclude, fallthru: v.Continue, excludeExternal: v.ExcludeExternal, conds: conds}
+		newRule := func(kind, pattern string, re *regexp.Regexp) dispatchRule {
+			r := base
+			r.kind, r.pattern, r.re = kind, pattern, re
+			return r
 		}
 
 		if v.Prefix != "" {
-			md.prefixMap[v.Prefix] = v.ChannelId
+			md.rules = append(md.rules, newRule("prefix", v.Prefix, nil))
 		}
 
 		if v.Suffix != "" {
-			md.suffixMap[v.Suffix] = v.ChannelId
+			md.rules = append(md.rules, newRule("suffix", v.Suffix, nil))
+		}
+
+		if v.Regex != "" {
+			re, err := regexp.Compile(v.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("rule #%d:invalid regex[%s]:%w", i, v.Regex, err)
+			}
+			md.rules = append(md.rules, newRule("regex", v.Regex, re))
+		}
+
+		if v.Glob != "" {
+			re, err := compileGlob(v.Glob)
+			if err != nil {
+				return nil, fmt.Errorf("rule #%d:invalid glob[%s]:%w", i, v.Glob, err)
+			}
+			md.rules = append(md.rules, newRule("glob", v.Glob, re))
+		}
+
+		if v.Prefix == "" && v.Suffix == "" && v.Regex == "" && v.Glob == "" {
+			if len(conds) == 0 {
+				return nil, fmt.Errorf("rule #%d:no pattern specified", i)
+			}
+			// matches messages in every channel
+			md.rules = append(md.rules, newRule("", "", nil))
 		}
 	}
 
-	if len(md.prefixMap)+len(md.suffixMap) == 0 {
+	if len(md.rules) == 0 {
 		return nil, errors.New("no dispatch rules found")
 	}
 
+	if err := sortDispatchRules(md.rules, cfg.Order); err != nil {
+		return nil, err
+	}
+
 	return &md, nil
 }
+
+// sortDispatchRules orders rules by priority(higher first). rules with the same priority
+// keep the order written in DISPATCH_CHANNEL, or the longer pattern comes first if order is "longest".
+func sortDispatchRules(rules []dispatchRule, order string) error {
+	switch order {
+	case "", dispatchOrderDeclared, dispatchOrderLongest:
+	default:
+		return fmt.Errorf("unknown DISPATCH_ORDER:%s", order)
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].priority > rules[j].priority
+	})
+
+	if order == dispatchOrderLongest {
+		for start := 0; start < len(rules); {
+			end := start
+			for end < len(rules) && rules[end].priority == rules[start].priority {
+				end++
+			}
+			sortLongestPatterns(rules[start:end])
+			start = end
+		}
+	}
+	return nil
+}
+
+// sortLongestPatterns reorders prefix and suffix rules by the pattern length.
+// the length is meaningless for regex and glob, so other rules keep their places.
+func sortLongestPatterns(rules []dispatchRule) {
+	var slots []int
+	var sorted []dispatchRule
+	for i := range rules {
+		if rules[i].kind == "prefix" || rules[i].kind == "suffix" {
+			slots = append(slots, i)
+			sorted = append(sorted, rules[i])
+		}
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].pattern) > len(sorted[j].pattern)
+	})
+	for i, slot := range slots {
+		rules[slot] = sorted[i]
+	}
+}
+
+// compileGlob converts a shell-like glob pattern into an anchored regexp.
+// supports `*`, `?`, `[...]`(`[!...]` negates) and `\` escape.
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	globRune := []rune(glob)
+
+	sb := strings.Builder{}
+	sb.WriteRune('^')
+	for i := 0; i < len(globRune); i++ {
+		switch globRune[i] {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteRune('.')
+		case '\\':
+			if i+1 == len(globRune) {
+				return nil, errors.New("trailing escape")
+			}
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(globRune[i])))
+		case '[':
+			end := -1
+			for j := i + 1; j < len(globRune); j++ {
+				// `]` right after `[` or `[!` is a literal
+				if globRune[j] == ']' && j > i+1 && !(j == i+2 && globRune[i+1] == '!') {
+					end = j
+					break
+				}
+			}
+			if end < 0 {
+				return nil, errors.New("unclosed character class")
+			}
+			class := globRune[i+1 : end]
+			sb.WriteRune('[')
+			if class[0] == '!' {
+				sb.WriteRune('^')
+				class = class[1:]
+			}
+			for _, c := range class {
+				if c == '\\' || c == '[' || c == ']' || c == '^' {
+					sb.WriteRune('\\')
+				}
+				sb.WriteRune(c)
+			}
+			sb.WriteRune(']')
+			i = end
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(globRune[i])))
+		}
+	}
+	sb.WriteRune('$')
+
+	return regexp.Compile(sb.String())
+}
@@ -1,13 +1,19 @@
 package common
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
+func chanRoute(chanName string) *RouteContext {
+	return &RouteContext{ChannelName: chanName}
+}
+
 func TestSimpleDispatcher(t *testing.T) {
 	os.Setenv("AGGREGATE_CHANNEL_ID", "CIDFOOBAR")
 	t.Cleanup(func() { os.Unsetenv("AGGREGATE_CHANNEL_ID") })
@@ -16,8 +22,8 @@ func TestSimpleDispatcher(t *testing.T) {
 
 	assert.Nil(t, err)
 	assert.Equal(t, "common.simpleDispatcher", reflect.TypeOf(d).String())
-	assert.Equal(t, "CIDFOOBAR", d.Dispatch("hoge"))
-	assert.Equal(t, "CIDFOOBAR", d.Dispatch("poyo"))
+	assert.Equal(t, []string{"CIDFOOBAR"}, d.Dispatch(chanRoute("hoge")))
+	assert.Equal(t, []string{"CIDFOOBAR"}, d.Dispatch(chanRoute("poyo")))
 }
 
 func TestMapDispatcher(t *testing.T) {
@@ -36,13 +42,13 @@ func TestMapDispatcher(t *testing.T) {
 
 	assert.Nil(t, err)
 	assert.Equal(t, "*common.mappedDispatcher", reflect.TypeOf(d).String())
-	assert.Equal(t, "", d.Dispatch("hoge"))
-	assert.Equal(t, "CIDTIMES", d.Dispatch("times_poyo"))
-	assert.Equal(t, "CIDTIMES", d.Dispatch("times_hoge"))
-	assert.Equal(t, "CIDTIMES", d.Dispatch("times_hoge_zatsu"))
-	assert.Equal(t, "CIDZATSU", d.Dispatch("timez_hoge_zatsu"))
-	assert.Equal(t, "", d.Dispatch("poyo"))
-	assert.Equal(t, "CIDFOOBAR", d.Dispatch("poyo_foobar"))
+	assert.Empty(t, d.Dispatch(chanRoute("hoge")))
+	assert.Equal(t, []string{"CIDTIMES"}, d.Dispatch(chanRoute("times_poyo")))
+	assert.Equal(t, []string{"CIDTIMES"}, d.Dispatch(chanRoute("times_hoge")))
+	assert.Equal(t, []string{"CIDTIMES"}, d.Dispatch(chanRoute("times_hoge_zatsu")))
+	assert.Equal(t, []string{"CIDZATSU"}, d.Dispatch(chanRoute("timez_hoge_zatsu")))
+	assert.Empty(t, d.Dispatch(chanRoute("poyo")))
+	assert.Equal(t, []string{"CIDFOOBAR"}, d.Dispatch(chanRoute("poyo_foobar")))
 
 }
 
@@ -61,8 +67,453 @@ func TestNewMapDispatcher(t *testing.T) {
 
 	v, err := newMapDispatcher()
 	assert.Nil(t, err)
-	assert.Equal(t, "CIDTIMES", v.prefixMap["times_"])
-	assert.Equal(t, "CIDZATSU", v.suffixMap["_zatsu"])
-	assert.Equal(t, "CIDFOOBAR", v.suffixMap["_foobar"])
+	assert.Equal(t, []dispatchRule{
+		{kind: "prefix", pattern: "times_", chanId: "CIDTIMES"},
+		{kind: "suffix", pattern: "_zatsu", chanId: "CIDZATSU"},
+		{kind: "suffix", pattern: "_foobar", chanId: "CIDFOOBAR"},
+	}, v.rules)
+
+}
+
+func TestMapDispatcherDeclaredOrder(t *testing.T) {
+	json := `[{"prefix": "times_",
+	"cid": "CIDTIMES"
+},{
+	"prefix": "times_eng_",
+	"cid": "CIDENG"
+},{
+	"suffix": "_zatsu",
+	"cid": "CIDZATSU",
+	"priority": 10
+}]`
+	os.Setenv("DISPATCH_CHANNEL", json)
+	t.Cleanup(func() { os.Unsetenv("DISPATCH_CHANNEL") })
+
+	d, err := NewDispatcher()
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, []string{"CIDTIMES"}, d.Dispatch(chanRoute("times_eng_bob")))
+	}
+	assert.Equal(t, []string{"CIDZATSU"}, d.Dispatch(chanRoute("times_eng_zatsu")))
+	assert.Equal(t, "suffix[_zatsu]->[CIDZATSU](priority:10)\nprefix[times_]->[CIDTIMES]\nprefix[times_eng_]->[CIDENG]", d.Rules())
+}
+
+func TestMapDispatcherLongestOrder(t *testing.T) {
+	json := `[{"prefix": "times_",
+	"cid": "CIDTIMES"
+},{
+	"prefix": "times_eng_",
+	"cid": "CIDENG"
+},{
+	"suffix": "_zatsu",
+	"cid": "CIDZATSU"
+}]`
+	os.Setenv("DISPATCH_CHANNEL", json)
+	os.Setenv("DISPATCH_ORDER", "longest")
+	t.Cleanup(func() {
+		os.Unsetenv("DISPATCH_CHANNEL")
+		os.Unsetenv("DISPATCH_ORDER")
+	})
+
+	d, err := NewDispatcher()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"CIDENG"}, d.Dispatch(chanRoute("times_eng_bob")))
+	assert.Equal(t, []string{"CIDTIMES"}, d.Dispatch(chanRoute("times_bob")))
+	assert.Equal(t, []string{"CIDENG"}, d.Dispatch(chanRoute("times_eng_zatsu")))
+	assert.Equal(t, []string{"CIDTIMES"}, d.Dispatch(chanRoute("times_zatsu")))
+	assert.Equal(t, "prefix[times_eng_]->[CIDENG]\nprefix[times_]->[CIDTIMES]\nsuffix[_zatsu]->[CIDZATSU]", d.Rules())
+
+	// regex and glob rules keep the declared place.
+	os.Setenv("DISPATCH_CHANNEL", `[{"regex": "^a.*$", "cid": "CIDA"}, {"prefix": "ab", "cid": "CIDAB"}, {"glob": "x*", "cid": "CIDX"}, {"prefix": "abc", "cid": "CIDABC"}]`)
+	d, err = NewDispatcher()
+	assert.Nil(t, err)
+	assert.Equal(t, "regex[^a.*$]->[CIDA]\nprefix[abc]->[CIDABC]\nglob[x*]->[CIDX]\nprefix[ab]->[CIDAB]", d.Rules())
+}
+
+func TestPatternDispatcher(t *testing.T) {
+	json := `[{"regex": "^proj-(alpha|beta)-.*$",
+	"cid": "CIDPROJ"
+},{
+	"glob": "team-*-ops",
+	"cid": "CIDOPS"
+},{
+	"glob": "dev[0-9]?",
+	"cid": "CIDDEV"
+}]`
+	os.Setenv("DISPATCH_CHANNEL", json)
+	t.Cleanup(func() { os.Unsetenv("DISPATCH_CHANNEL") })
+
+	d, err := NewDispatcher()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"CIDPROJ"}, d.Dispatch(chanRoute("proj-alpha-general")))
+	assert.Equal(t, []string{"CIDPROJ"}, d.Dispatch(chanRoute("proj-beta-")))
+	assert.Empty(t, d.Dispatch(chanRoute("proj-gamma-general")))
+	assert.Equal(t, []string{"CIDOPS"}, d.Dispatch(chanRoute("team-infra-ops")))
+	assert.Empty(t, d.Dispatch(chanRoute("team-infra-ops-log")))
+	assert.Equal(t, []string{"CIDDEV"}, d.Dispatch(chanRoute("dev1x")))
+	assert.Empty(t, d.Dispatch(chanRoute("devx1")))
+}
+
+func TestInvalidDispatchRules(t *testing.T) {
+	t.Cleanup(func() { os.Unsetenv("DISPATCH_CHANNEL") })
+
+	for _, json := range []string{
+		`[{"regex": "^proj-(alpha", "cid": "CIDPROJ"}]`,
+		`[{"glob": "team-[ops", "cid": "CIDOPS"}]`,
+		`[{"prefix": "times_"}]`,
+		`[{"cid": "CIDNONE"}]`,
+		`[{"prefix": "times_"`,
+	} {
+		os.Setenv("DISPATCH_CHANNEL", json)
+		d, err := NewDispatcher()
+		assert.Nil(t, d, json)
+		assert.NotNil(t, err, json)
+	}
+}
+
+func TestCompileGlob(t *testing.T) {
+	for glob, expected := range map[string]string{
+		"team-*-ops": `^team-.*-ops$`,
+		"a?c":        `^a.c$`,
+		"[!a-c]x":    `^[^a-c]x$`,
+		"[]]":        `^[\]]$`,
+		`\*`:         `^\*$`,
+	} {
+		re, err := compileGlob(glob)
+		assert.Nil(t, err, glob)
+		assert.Equal(t, expected, re.String(), glob)
+	}
+
+	for _, glob := range []string{"[abc", `abc\`, "[z-a]"} {
+		_, err := compileGlob(glob)
+		assert.NotNil(t, err, glob)
+	}
+}
+
+func TestExcludeDispatcher(t *testing.T) {
+	json := `[{"suffix": "-secret",
+	"exclude": true
+},{
+	"prefix": "times_",
+	"cid": "CIDTIMES"
+}]`
+	os.Setenv("DISPATCH_CHANNEL", json)
+	os.Setenv("AGGREGATE_CHANNEL_ID", "CIDFIREHOSE")
+	t.Cleanup(func() {
+		os.Unsetenv("DISPATCH_CHANNEL")
+		os.Unsetenv("AGGREGATE_CHANNEL_ID")
+	})
+
+	d, err := NewDispatcher()
+	assert.Nil(t, err)
+	assert.Equal(t, "*common.mappedDispatcher", reflect.TypeOf(d).String())
+	assert.Equal(t, []string{"CIDTIMES"}, d.Dispatch(chanRoute("times_hoge")))
+	assert.Empty(t, d.Dispatch(chanRoute("times_hoge-secret")))
+	assert.Empty(t, d.Dispatch(chanRoute("hoge-secret")))
+	assert.Equal(t, []string{"CIDFIREHOSE"}, d.Dispatch(chanRoute("hoge")))
+	assert.Equal(t, "suffix[-secret]->(exclude)\nprefix[times_]->[CIDTIMES]\ndefault->[CIDFIREHOSE]", d.Rules())
+}
+
+func TestExcludeSimpleDispatcher(t *testing.T) {
+	os.Setenv("DISPATCH_CHANNEL", `[{"glob": "*-secret", "exclude": true}]`)
+	os.Setenv("AGGREGATE_CHANNEL_ID", "CIDFIREHOSE")
+	t.Cleanup(func() {
+		os.Unsetenv("DISPATCH_CHANNEL")
+		os.Unsetenv("AGGREGATE_CHANNEL_ID")
+	})
+
+	d, err := NewDispatcher()
+	assert.Nil(t, err)
+	assert.Equal(t, "common.simpleDispatcher", reflect.TypeOf(d).String())
+	assert.Equal(t, []string{"CIDFIREHOSE"}, d.Dispatch(chanRoute("hoge")))
+	assert.Empty(t, d.Dispatch(chanRoute("hoge-secret")))
+
+	os.Unsetenv("AGGREGATE_CHANNEL_ID")
+	d, err = NewDispatcher()
+	assert.Nil(t, d)
+	assert.NotNil(t, err)
+}
+
+func TestFanOutDispatcher(t *testing.T) {
+	json := `[{"prefix": "times_",
+	"cid": "CIDTIMES",
+	"continue": true
+},{
+	"glob": "*_eng_*",
+	"cid": "CIDENG",
+	"continue": true
+},{
+	"prefix": "times_eng_",
+	"cid": "CIDTIMES"
+}]`
+	os.Setenv("DISPATCH_CHANNEL", json)
+	os.Setenv("AGGREGATE_CHANNEL_ID", "CIDFIREHOSE")
+	t.Cleanup(func() {
+		os.Unsetenv("DISPATCH_CHANNEL")
+		os.Unsetenv("AGGREGATE_CHANNEL_ID")
+	})
+
+	d, err := NewDispatcher()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"CIDTIMES", "CIDENG"}, d.Dispatch(chanRoute("times_eng_bob")))
+	assert.Equal(t, []string{"CIDTIMES"}, d.Dispatch(chanRoute("times_bob")))
+	assert.Equal(t, []string{"CIDENG"}, d.Dispatch(chanRoute("proj_eng_bob")))
+	assert.Equal(t, []string{"CIDFIREHOSE"}, d.Dispatch(chanRoute("bob")))
+
+	assert.Equal(t, []string{"prefix[times_]->[CIDTIMES](continue)", "glob[*_eng_*]->[CIDENG](continue)", "prefix[times_eng_]->[CIDTIMES]"}, d.Explain(chanRoute("times_eng_bob")))
+	assert.Equal(t, []string{"default->[CIDFIREHOSE]"}, d.Explain(chanRoute("bob")))
+}
+
+func TestAuthorDispatcher(t *testing.T) {
+	json := `[{"users": ["ULEAD1", "ULEAD2"],
+	"cid": "CIDLEADERS"
+},{
+	"usergroups": ["SNEWHIRE"],
+	"prefix": "times_",
+	"cid": "CIDNEWHIRE"
+},{
+	"profile": {"title": "(?i)^director"},
+	"cid": "CIDLEADERS"
+}]`
+	os.Setenv("DISPATCH_CHANNEL", json)
+	t.Cleanup(func() { os.Unsetenv("DISPATCH_CHANNEL") })
+
+	d, err := NewDispatcher()
+	assert.Nil(t, err)
+
+	groups := map[string][]string{"SNEWHIRE": {"UNEW"}}
+	route := func(chanName, uid, title string) *RouteContext {
+		return &RouteContext{
+			ChannelName: chanName,
+			UserID:      uid,
+			Profile:     &UserProfile{Name: uid, Title: title},
+			inUserGroup: func(gid string) bool {
+				for _, v := range groups[gid] {
+					if v == uid {
+						return true
+					}
+				}
+				return false
+			},
+		}
+	}
+
+	assert.Equal(t, []string{"CIDLEADERS"}, d.Dispatch(route("general", "ULEAD1", "")))
+	assert.Equal(t, []string{"CIDNEWHIRE"}, d.Dispatch(route("times_new", "UNEW", "")))
+	assert.Empty(t, d.Dispatch(route("general", "UNEW", "")))
+	assert.Equal(t, []string{"CIDLEADERS"}, d.Dispatch(route("general", "UDIR", "Director of Eng")))
+	assert.Empty(t, d.Dispatch(route("general", "UENG", "Engineer")))
+	assert.Equal(t, "user[ULEAD1,ULEAD2]->[CIDLEADERS]\nprefix[times_]&usergroup[SNEWHIRE]->[CIDNEWHIRE]\nprofile.title[(?i)^director]->[CIDLEADERS]", d.Rules())
+
+	os.Setenv("DISPATCH_CHANNEL", `[{"profile": {"shoe_size": "28"}, "cid": "CIDSHOES"}]`)
+	d, err = NewDispatcher()
+	assert.Nil(t, d)
+	assert.NotNil(t, err)
+}
+
+func TestContentDispatcher(t *testing.T) {
+	json := `[{"keywords": ["Outage", "障害"],
+	"cid": "CIDINCIDENT",
+	"continue": true
+},{
+	"text": "https://tracker\\.example\\.com/incidents/[0-9]+",
+	"cid": "CIDINCIDENT"
+},{
+	"prefix": "times_",
+	"text": "<＠alice>",
+	"cid": "CIDALICE"
+}]`
+	os.Setenv("DISPATCH_CHANNEL", json)
+	t.Cleanup(func() { os.Unsetenv("DISPATCH_CHANNEL") })
+
+	d, err := NewDispatcher()
+	assert.Nil(t, err)
+
+	route := func(chanName, text string) *RouteContext {
+		return &RouteContext{ChannelName: chanName, Text: text}
+	}
+
+	assert.Equal(t, []string{"CIDINCIDENT"}, d.Dispatch(route("general", "we have an OUTAGE now")))
+	assert.Equal(t, []string{"CIDINCIDENT"}, d.Dispatch(route("general", "DB障害発生")))
+	assert.Equal(t, []string{"CIDINCIDENT"}, d.Dispatch(route("general", "see <https://tracker.example.com/incidents/42>")))
+	assert.Empty(t, d.Dispatch(route("general", "see <https://tracker.example.com/>")))
+	assert.Equal(t, []string{"CIDALICE"}, d.Dispatch(route("times_bob", "hi <＠alice>")))
+	assert.Empty(t, d.Dispatch(route("general", "hi <＠alice>")))
+}
+
+func TestFileDispatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aggrechans.yaml")
+	yaml := `order: longest
+default: CIDFIREHOSE
+rules:
+  - prefix: times_
+    cid: CIDTIMES
+  - prefix: times_eng_
+    cid: CIDENG
+`
+	assert.Nil(t, ioutil.WriteFile(path, []byte(yaml), 0644))
+	os.Setenv("AGGRECHANS_CONFIG", path)
+	t.Cleanup(func() { os.Unsetenv("AGGRECHANS_CONFIG") })
+
+	d, err := NewDispatcher()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"CIDENG"}, d.Dispatch(chanRoute("times_eng_bob")))
+	assert.Equal(t, []string{"CIDFIREHOSE"}, d.Dispatch(chanRoute("general")))
+
+	fd := d.(*fileDispatcher)
+
+	// invalid config is rejected and the last rules are kept.
+	assert.Nil(t, ioutil.WriteFile(path, []byte("rules:\n  - regex: \"(\"\n    cid: CIDBROKEN\n"), 0644))
+	assert.NotNil(t, fd.reload())
+	assert.Equal(t, []string{"CIDENG"}, d.Dispatch(chanRoute("times_eng_bob")))
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("- suffix: _bob\n  cid: CIDBOB\n"), 0644))
+	assert.True(t, fd.modified())
+	assert.Nil(t, fd.reload())
+	assert.False(t, fd.modified())
+	assert.Equal(t, []string{"CIDBOB"}, d.Dispatch(chanRoute("times_eng_bob")))
+	assert.Empty(t, d.Dispatch(chanRoute("general")))
+}
+
+func TestParseDispatchConfig(t *testing.T) {
+	cfg, err := parseDispatchConfig([]byte(`{"default": "CIDFIREHOSE", "rules": [{"suffix": "-secret", "exclude": true}]}`), true)
+	assert.Nil(t, err)
+	assert.Equal(t, "CIDFIREHOSE", cfg.Default)
+	assert.Equal(t, dispatchInfo{{Suffix: "-secret", Exclude: true}}, cfg.Rules)
+
+	cfg, err = parseDispatchConfig([]byte(`[{"prefix": "times_", "cid": "CIDTIMES"}]`), true)
+	assert.Nil(t, err)
+	assert.Equal(t, dispatchInfo{{Prefix: "times_", ChannelId: "CIDTIMES"}}, cfg.Rules)
+
+	// typo is rejected
+	_, err = parseDispatchConfig([]byte("rules:\n  - prefx: times_\n    cid: CIDTIMES\n"), false)
+	assert.NotNil(t, err)
+	_, err = parseDispatchConfig([]byte(`[{"prefx": "times_", "cid": "CIDTIMES"}]`), true)
+	assert.NotNil(t, err)
+}
+
+func TestChannelIdDispatcher(t *testing.T) {
+	json := `[{"channel_ids": ["CPINNED"],
+	"cid": "CIDPINNED"
+},{
+	"prefix": "times_",
+	"cid": "CIDTIMES"
+}]`
+	os.Setenv("DISPATCH_CHANNEL", json)
+	t.Cleanup(func() { os.Unsetenv("DISPATCH_CHANNEL") })
+
+	d, err := NewDispatcher()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"CIDPINNED"}, d.Dispatch(&RouteContext{ChannelID: "CPINNED", ChannelName: "times_hoge"}))
+	assert.Equal(t, []string{"CIDPINNED"}, d.Dispatch(&RouteContext{ChannelID: "CPINNED", ChannelName: "renamed"}))
+	assert.Equal(t, []string{"CIDTIMES"}, d.Dispatch(&RouteContext{ChannelID: "COTHER", ChannelName: "times_hoge"}))
+	assert.Equal(t, "channel[CPINNED]->[CIDPINNED]\nprefix[times_]->[CIDTIMES]", d.Rules())
+}
+
+func TestDestinationOptions(t *testing.T) {
+	json := `{"rules": [{"prefix": "times_",
+	"cid": "CIDTIMES"
+}],
+"destinations": {"CIDTIMES": {"on_delete": "placeholder", "threads": true}}}`
+	os.Setenv("DISPATCH_CHANNEL", json)
+	t.Cleanup(func() { os.Unsetenv("DISPATCH_CHANNEL") })
+
+	d, err := NewDispatcher()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"CIDTIMES"}, d.Dispatch(chanRoute("times_hoge")))
+	assert.Equal(t, "placeholder", d.Destination("CIDTIMES").OnDelete)
+	assert.True(t, d.Destination("CIDTIMES").Threads)
+	assert.Equal(t, "delete", d.Destination("CIDOTHER").OnDelete)
+	assert.False(t, d.Destination("CIDOTHER").Threads)
+	assert.Equal(t, "prefix[times_]->[CIDTIMES]\ndestination[CIDTIMES]:on_delete=placeholder,threads=true", d.Rules())
+
+	os.Setenv("DISPATCH_CHANNEL", `{"rules": [{"prefix": "times_", "cid": "CIDTIMES"}], "destinations": {"CIDTIMES": {"on_delete": "shred"}}}`)
+	d, err = NewDispatcher()
+	assert.Nil(t, d)
+	assert.NotNil(t, err)
+
+	// unknown keys are warned and ignored unlike config files
+	os.Setenv("DISPATCH_CHANNEL", `{"rules": [{"prefix": "times_", "cid": "CIDTIMES"}], "destiantions": {}}`)
+	d, err = NewDispatcher()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"CIDTIMES"}, d.Dispatch(chanRoute("times_hoge")))
+	os.Setenv("DISPATCH_CHANNEL", `{"rules": [{"prefix": "times_", "cid": "CIDTIMES"}], "destinations": {"CIDTIMES": {"digest": {"messages": 20}}}}`)
+	d, err = NewDispatcher()
+	assert.Nil(t, err)
+	assert.Equal(t, &DigestOptions{Minutes: 60, Messages: 20}, d.Destination("CIDTIMES").Digest)
+	assert.Nil(t, d.Destination("CIDOTHER").Digest)
+	assert.Equal(t, "prefix[times_]->[CIDTIMES]\ndestination[CIDTIMES]:on_delete=delete,threads=false,digest=60min/20msgs", d.Rules())
+
+	os.Setenv("DISPATCH_CHANNEL", `{"rules": [{"prefix": "times_", "cid": "CIDTIMES"}], "destinations": {"CIDTIMES": {"rename_notice": true}}}`)
+	d, err = NewDispatcher()
+	assert.Nil(t, err)
+	assert.True(t, d.Destination("CIDTIMES").RenameNotice)
+	assert.False(t, d.Destination("CIDOTHER").RenameNotice)
+	assert.Equal(t, "prefix[times_]->[CIDTIMES]\ndestination[CIDTIMES]:on_delete=delete,threads=false,rename_notice=true", d.Rules())
+
+	os.Setenv("DISPATCH_CHANNEL", `{"rules": [{"prefix": "times_", "cid": "CIDTIMES"}], "destinations": {"CIDTIMES": {"digest": {}}}}`)
+	d, err = NewDispatcher()
+	assert.Nil(t, d)
+	assert.NotNil(t, err)
+}
+
+func TestPrivateChannels(t *testing.T) {
+	os.Setenv("AGGREGATE_CHANNEL_ID", "CIDFIREHOSE")
+	os.Setenv("PRIVATE_CHANNEL_IDS", "GALLOWED, GOTHER")
+	t.Cleanup(func() {
+		os.Unsetenv("AGGREGATE_CHANNEL_ID")
+		os.Unsetenv("PRIVATE_CHANNEL_IDS")
+	})
+
+	d, err := NewDispatcher()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"CIDFIREHOSE"}, d.Dispatch(&RouteContext{ChannelID: "CPUBLIC", ChannelName: "general"}))
+	assert.Equal(t, []string{"CIDFIREHOSE"}, d.Dispatch(&RouteContext{ChannelID: "GALLOWED", ChannelName: "secret", Private: true}))
+	assert.Nil(t, d.Dispatch(&RouteContext{ChannelID: "GDENIED", ChannelName: "secret", Private: true}))
+	assert.Equal(t, []string{privateNotAllowedRule}, d.Explain(&RouteContext{ChannelID: "GDENIED", ChannelName: "secret", Private: true}))
+	assert.Equal(t, "send every message to:CIDFIREHOSE\nprivate[GALLOWED,GOTHER]", d.Rules())
+
+	// the config overrides PRIVATE_CHANNEL_IDS.
+	os.Setenv("DISPATCH_CHANNEL", `{"rules": [{"prefix": "times_", "cid": "CIDTIMES"}], "private_channels": ["GTIMES"]}`)
+	t.Cleanup(func() { os.Unsetenv("DISPATCH_CHANNEL") })
+
+	d, err = NewDispatcher()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"CIDTIMES"}, d.Dispatch(&RouteContext{ChannelID: "GTIMES", ChannelName: "times_bob", Private: true}))
+	assert.Equal(t, []string{"CIDTIMES"}, d.Dispatch(&RouteContext{ChannelID: "GALLOWED", ChannelName: "times_bob"}))
+	assert.Nil(t, d.Dispatch(&RouteContext{ChannelID: "GALLOWED", ChannelName: "times_bob", Private: true}))
+}
+
+func TestExternalDispatcher(t *testing.T) {
+	os.Setenv("AGGREGATE_CHANNEL_ID", "CIDFIREHOSE")
+	os.Setenv("DISPATCH_CHANNEL", `[{"prefix": "shared-", "exclude_external": true, "cid": "CIDSHARED"}]`)
+	t.Cleanup(func() {
+		os.Unsetenv("AGGREGATE_CHANNEL_ID")
+		os.Unsetenv("DISPATCH_CHANNEL")
+	})
+
+	alice := &UserProfile{Name: "alice"}
+	bob := &UserProfile{Name: "bob", External: true, Org: "Partner"}
+
+	d, err := NewDispatcher()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"CIDSHARED"}, d.Dispatch(&RouteContext{ChannelName: "shared-partner", Profile: alice}))
+	// not fall through to the default
+	assert.Empty(t, d.Dispatch(&RouteContext{ChannelName: "shared-partner", Profile: bob}))
+	assert.Equal(t, []string{"CIDFIREHOSE"}, d.Dispatch(&RouteContext{ChannelName: "general", Profile: bob}))
+	assert.Equal(t, "prefix[shared-]->[CIDSHARED](exclude external)\ndefault->[CIDFIREHOSE]", d.Rules())
+
+	// excluded everywhere
+	os.Setenv("DISPATCH_CHANNEL", `[{"exclude": true, "external": true}, {"prefix": "shared-", "cid": "CIDSHARED"}]`)
+	d, err = NewDispatcher()
+	assert.Nil(t, err)
+	assert.Empty(t, d.Dispatch(&RouteContext{ChannelName: "shared-partner", Profile: bob}))
+	assert.Empty(t, d.Dispatch(&RouteContext{ChannelName: "general", Profile: bob}))
+	assert.Equal(t, []string{"CIDSHARED"}, d.Dispatch(&RouteContext{ChannelName: "shared-partner", Profile: alice}))
+	assert.Equal(t, []string{"CIDFIREHOSE"}, d.Dispatch(&RouteContext{ChannelName: "general", Profile: alice}))
 
+	os.Setenv("DISPATCH_CHANNEL", `[{"exclude": true, "exclude_external": true}]`)
+	d, err = NewDispatcher()
+	assert.Nil(t, d)
+	assert.NotNil(t, err)
 }
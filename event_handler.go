@@ -2,28 +2,59 @@ package common
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/slack-go/slack"
 	"github.com/slack-go/slack/slackevents"
 )
 
-type DestinationChannelFunc func(chanName string) string
+// post a notice to destinations when renaming a channel changes its destinations.
+
+// Aggregator mirrors messages into destination channels.
+type Aggregator struct {
+	API         *slack.Client
+	ChannelInfo *ChannelInfo
+	UserInfo    *UserInfo
+	Dispatcher  ChannelDispatcher
+	// mapping from source messages to mirrored messages
+	Mirrors MirrorStore
+	// messages are sent directly if nil
+	Outbox Outbox
+	// undeliverable messages are only logged if nil
+	DeadLetters DeadLetterStore
+	// redelivered events are processed again if nil
+	Dedup Deduplicator
+	// digest destinations are mirrored 1:1 if nil
+	Digests DigestStore
+}
+
+func (agg *Aggregator) CallbackEventHandler(ctx context.Context, eventsAPIEvent slackevents.EventsAPIEvent) error {
+	// events are acked before handled and never redelivered on failure. failed posts are retried by the outbox instead.
+	if agg.Dedup != nil {
+		if keys := eventKeys(eventsAPIEvent); len(keys) > 0 && agg.Dedup.Seen(ctx, keys...) {
+			fmt.Printf("duplicated event ignored:%v\n", keys)
+			return nil
+		}
+	}
 
-func CallbackEventHandler(ctx context.Context, api *slack.Client, eventsAPIEvent slackevents.EventsAPIEvent,
-	ci *ChannelInfo, ui *UserInfo, destChFn DestinationChannelFunc) error {
 	innerEvent := eventsAPIEvent.InnerEvent
 	switch ev := innerEvent.Data.(type) {
 	case *slackevents.MessageEvent:
-		return messageEventHandler(ctx, api, ev, ci, ui, destChFn)
+		return agg.messageEventHandler(ctx, ev, sourceBlocks(eventsAPIEvent))
 	case *slackevents.ChannelRenameEvent:
-		ci.UpdateName(ctx, ev.Channel)
+		old, ok := agg.ChannelInfo.UpdateName(ctx, ev.Channel)
+		if ok {
+			return agg.channelRenameNotice(ctx, ev.Channel.ID, old, ev.Channel.Name)
+		}
 	case *slack.UserChangeEvent:
-		ui.HandleUserChangeEvent(ctx, ev)
+		agg.UserInfo.HandleUserChangeEvent(ctx, ev)
 	case *slackevents.ChannelCreatedEvent:
-		ci.HandleCreateEvent(ctx, ev.Channel)
+		agg.ChannelInfo.HandleCreateEvent(ctx, ev.Channel)
 	case *slackevents.ChannelUnarchiveEvent:
-		name, err := ci.GetName(ctx, ev.Channel)
+		name, err := agg.ChannelInfo.GetName(ctx, ev.Channel)
 		if err != nil {
 			return fmt.Errorf("failure handling unarchive channel(id=%s):%w", ev.Channel, err)
 		}
@@ -34,16 +65,29 @@ func CallbackEventHandler(ctx context.Context, api *slack.Client, eventsAPIEvent
 	return nil
 }
 
-func messageEventHandler(ctx context.Context, api *slack.Client, ev *slackevents.MessageEvent,
-	ci *ChannelInfo, ui *UserInfo, destChFn DestinationChannelFunc) error {
+func (agg *Aggregator) messageEventHandler(ctx context.Context, ev *slackevents.MessageEvent, rawBlocks []rawBlock) error {
+	ci, ui := agg.ChannelInfo, agg.UserInfo
 
+	// DMs are never forwarded.
+	if ev.ChannelType == channelTypeIm {
+		return nil
+	}
+
+	// src is the message to be mirrored.
+	src := ev
 	text := ev.Text
 	uid := ev.User
 	switch ev.SubType {
 	case slack.MsgSubTypeBotMessage:
 		return nil
+	case slack.MsgSubTypeMessageDeleted:
+		return agg.messageDeletedHandler(ctx, ev)
 	case slack.MsgSubTypeMessageChanged:
 		if ev.Message != nil {
+			src = &slackevents.MessageEvent{}
+			*src = *ev.Message
+			src.Channel = ev.Channel
+			src.ChannelType = ev.ChannelType
 			text = ev.Message.Text
 			if ev.Message.Edited != nil {
 				uid = ev.Message.Edited.User
@@ -60,50 +104,461 @@ func messageEventHandler(ctx context.Context, api *slack.Client, ev *slackevents
 		return nil
 	}
 
-	prof, err := ui.GetUserProfile(ctx, uid)
+	prof, err := agg.authorProfile(ctx, uid, src.UserTeam)
 	if err != nil {
-		return fmt.Errorf("cannot get user profile:%w", err)
+		return err
 	}
 
 	if prof.IsBots() {
 		return nil
 	}
 
-	chanName, err := ci.GetName(ctx, ev.Channel)
+	// content rules match against resolved user names.
+	resolvedText, err := ui.ReplaceMentionUIDs(ctx, text)
+	if err != nil {
+		return fmt.Errorf("cannot resolve mentions:%w", err)
+	}
+
+	rc, err := agg.routeContext(ctx, ev, uid, prof, resolvedText)
 	if err != nil {
-		return fmt.Errorf("cannot resolve cnannel name(lookup):%w", err)
+		return err
 	}
 
-	dstChannel := destChFn(chanName)
-	if dstChannel == "" {
+	dstChannels := agg.Dispatcher.Dispatch(rc)
+	if len(dstChannels) == 0 {
 		return nil
 	}
 
-	msgLink, err := ci.GetMessageLink(ctx, ev)
+	msgLink, err := ci.GetMessageLink(ctx, src)
 	if err != nil {
 		return fmt.Errorf("cannot resolve cnannel name(genLink):%w", err)
 	}
 
-	msg := ""
-	disableUnfurlLink := true
-	switch ev.SubType {
-	case slack.MsgSubTypeFileShare:
-		msg = ""
-		disableUnfurlLink = false
-	default:
-		msg, err = ui.ReplaceMentionUIDs(ctx, text)
+	body := EscapeChannelCall(agg.resolveReferences(ctx, resolvedText))
+	fullMsg := msgLink + " " + body
+
+	// blocks and attachments are reposted with mentions resolved. fullMsg remains as the notification text.
+	var blocks []slack.Block
+	if len(rawBlocks) > 0 {
+		blocks, err = agg.translateBlocks(ctx, rawBlocks, src)
+		if err != nil {
+			return fmt.Errorf("cannot translate blocks:%w", err)
+		}
+	}
+
+	// shared files follow the caption.
+	if len(src.Files) > 0 {
+		if len(blocks) == 0 {
+			blocks = append(blocks, mrkdwnSection(fullMsg))
+		}
+		blocks = append(blocks, fileBlocks(src.Files)...)
+		fullMsg += "\n" + strings.Join(fileLines(src.Files), "\n")
+	}
+
+	attachments, err := agg.translateAttachments(ctx, src.Attachments)
+	if err != nil {
+		return fmt.Errorf("cannot translate attachments:%w", err)
+	}
+
+	// digests show files in the line.
+	digestBody := body
+	if len(src.Files) > 0 {
+		digestBody += " " + strings.Join(fileLines(src.Files), " ")
+	}
+
+	var blocksJson json.RawMessage
+	if len(blocks) > 0 {
+		blocksJson, err = json.Marshal(blocks)
+		if err != nil {
+			return fmt.Errorf("cannot marshal blocks:%w", err)
+		}
+	}
+
+	// a failure at one destination does not block the others.
+	var errs []string
+	for _, dstChannel := range dstChannels {
+		if agg.Digests != nil && agg.Dispatcher.Destination(dstChannel).Digest != nil {
+			// digests are not updated.
+			if ev.SubType == slack.MsgSubTypeMessageChanged {
+				continue
+			}
+			if err := agg.addDigest(ctx, dstChannel, src, prof, digestBody); err != nil {
+				errs = append(errs, err.Error())
+			}
+			continue
+		}
+
+		msg := &OutboxMessage{
+			Op:          OutboxOpMirror,
+			Dst:         dstChannel,
+			Channel:     src.Channel,
+			ChannelType: src.ChannelType,
+			TimeStamp:   src.TimeStamp,
+			// edited messages update mirrored copies.
+			Edited:      ev.SubType == slack.MsgSubTypeMessageChanged,
+			Username:    prof.Label(),
+			IconURL:     prof.Avatar,
+			Text:        fullMsg,
+			Blocks:      blocksJson,
+			Attachments: attachments,
+		}
+		if isThreadReply(src) && agg.Dispatcher.Destination(dstChannel).Threads {
+			msg.ThreadTimeStamp = src.ThreadTimeStamp
+		}
+
+		if err := agg.enqueue(ctx, msg); err != nil {
+			errs = append(errs, fmt.Sprintf("(dst=%s):%v", dstChannel, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("postMessage err:%s", strings.Join(errs, ","))
+	}
+
+	return nil
+}
+
+// authorProfile returns the profile of the message author.
+func (agg *Aggregator) authorProfile(ctx context.Context, uid, userTeam string) (*UserProfile, error) {
+	prof, err := agg.UserInfo.GetUserProfile(ctx, uid)
+	if err != nil {
+		// users of other organizations may be invisible to the app.
+		if userTeam == "" {
+			return nil, fmt.Errorf("cannot get user profile:%w", err)
+		}
+		fmt.Fprintf(os.Stderr, "cannot get external user profile:%v\n", err)
+		prof = agg.UserInfo.externalProfile(ctx, uid, userTeam)
+	}
+	return prof, nil
+}
+
+// routeContext builds the context to dispatch the message posted in the channel of ev.
+func (agg *Aggregator) routeContext(ctx context.Context, ev *slackevents.MessageEvent, uid string, prof *UserProfile, resolvedText string) (*RouteContext, error) {
+	chanName, err := agg.ChannelInfo.GetName(ctx, ev.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve cnannel name(lookup):%w", err)
+	}
+
+	return &RouteContext{
+		ChannelID:   ev.Channel,
+		ChannelName: chanName,
+		UserID:      uid,
+		Profile:     prof,
+		SubType:     ev.SubType,
+		Private:     isPrivateChannelType(ev.ChannelType),
+		Text:        resolvedText,
+		inUserGroup: agg.UserInfo.userGroupMatcher(ctx, uid),
+	}, nil
+}
+
+// enqueue queues the message to the outbox, or delivers it at once without the outbox.
+func (agg *Aggregator) enqueue(ctx context.Context, msg *OutboxMessage) error {
+	if agg.Outbox == nil {
+		return agg.deliverOrDeadLetter(ctx, msg)
+	}
+	return agg.Outbox.Push(ctx, msg)
+}
+
+// Start runs workers of the outbox and the digest timer.
+func (agg *Aggregator) Start(ctx context.Context) {
+	if agg.Outbox != nil {
+		agg.Outbox.Start(ctx, agg.deliverOrDeadLetter)
+	}
+	if agg.Digests != nil {
+		go agg.digestLoop(ctx)
+	}
+}
+
+// deliverOrDeadLetter saves the message to the dead letters if it cannot be delivered even with retries.
+func (agg *Aggregator) deliverOrDeadLetter(ctx context.Context, msg *OutboxMessage) error {
+	err := agg.deliver(ctx, msg)
+	if err == nil || agg.DeadLetters == nil || ctx.Err() != nil {
+		// messages interrupted by shutdown are left in the outbox.
+		return err
+	}
+
+	if dlErr := agg.DeadLetters.Add(ctx, msg, err); dlErr != nil {
+		fmt.Fprintf(os.Stderr, "cannot save dead letter %s:%v\n", msg, dlErr)
+	}
+	return err
+}
+
+// deliver sends a message queued in the outbox.
+func (agg *Aggregator) deliver(ctx context.Context, msg *OutboxMessage) error {
+	switch msg.Op {
+	case OutboxOpMirror:
+		return agg.deliverMirror(ctx, msg)
+	case OutboxOpDelete:
+		return agg.deliverDelete(ctx, msg)
+	case OutboxOpDigest:
+		_, err := PostMessage(ctx, agg.API, &UserProfile{Name: msg.Username}, nil, true, msg.Text, msg.Dst)
+		return err
+	case OutboxOpNotice:
+		_, _, err := postMessageWithRetry(ctx, agg.API, msg.Dst, slack.MsgOptionText(msg.Text, false))
+		return err
+	}
+	return fmt.Errorf("unknown outbox operation:%s", msg.Op)
+}
+
+func (agg *Aggregator) deliverMirror(ctx context.Context, msg *OutboxMessage) error {
+	blocks, err := msg.blocks()
+	if err != nil {
+		return err
+	}
+
+	// mirrors are looked up here since the copy may have been queued just before.
+	if msg.Edited {
+		mirrors, err := agg.Mirrors.Get(ctx, msg.Channel, msg.TimeStamp)
 		if err != nil {
-			return fmt.Errorf("cannot resolve mentions:%w", err)
+			fmt.Fprintf(os.Stderr, "cannot lookup mirrored messages:%v\n", err)
+		}
+		if mirror, ok := findMirror(mirrors, msg.Dst); ok {
+			return UpdateMessage(ctx, agg.API, &blocks, true, msg.Text, mirror.Channel, mirror.TimeStamp,
+				slack.MsgOptionAttachments(msg.Attachments...))
 		}
-		msg = EscapeChannelCall(msg)
 	}
 
-	fullMsg := msgLink + " " + msg
+	var extra []slack.MsgOption
+	if len(msg.Attachments) > 0 {
+		extra = append(extra, slack.MsgOptionAttachments(msg.Attachments...))
+	}
+	if msg.ThreadTimeStamp != "" {
+		src := &slackevents.MessageEvent{Channel: msg.Channel, ChannelType: msg.ChannelType, TimeStamp: msg.TimeStamp, ThreadTimeStamp: msg.ThreadTimeStamp}
+		parent, err := agg.mirrorThreadParent(ctx, src, msg.Dst)
+		if err != nil {
+			return err
+		}
+		extra = append(extra, slack.MsgOptionTS(parent.TimeStamp))
+	}
 
-	err = PostMessage(ctx, api, prof, nil, disableUnfurlLink, fullMsg, dstChannel)
+	prof := &UserProfile{Name: msg.Username, Avatar: msg.IconURL}
+	ts, err := PostMessage(ctx, agg.API, prof, &blocks, true, msg.Text, msg.Dst, extra...)
 	if err != nil {
-		return fmt.Errorf("postMessage err:%w", err)
+		return err
 	}
 
+	err = agg.Mirrors.Add(ctx, msg.Channel, msg.TimeStamp, Mirror{Channel: msg.Dst, TimeStamp: ts})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot save mirrored message:%v\n", err)
+	}
 	return nil
 }
+
+func (agg *Aggregator) deliverDelete(ctx context.Context, msg *OutboxMessage) error {
+	mirror := msg.Mirror
+	if mirror == nil {
+		mirrors, err := agg.Mirrors.Get(ctx, msg.Channel, msg.TimeStamp)
+		if err != nil {
+			return fmt.Errorf("cannot lookup mirrored messages:%w", err)
+		}
+		m, ok := findMirror(mirrors, msg.Dst)
+		if !ok {
+			// not posted to the destination.
+			return nil
+		}
+		mirror = &m
+	}
+
+	var err error
+	switch agg.Dispatcher.Destination(msg.Dst).OnDelete {
+	case onDeleteDelete:
+		err = deleteMessageWithRetry(ctx, agg.API, mirror.Channel, mirror.TimeStamp)
+	case onDeletePlaceholder:
+		err = UpdateMessage(ctx, agg.API, nil, true, msg.Text, mirror.Channel, mirror.TimeStamp,
+			slack.MsgOptionAttachments([]slack.Attachment{}...))
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := agg.Mirrors.Delete(ctx, msg.Channel, msg.TimeStamp, msg.Dst); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot delete mirrored message:%v\n", err)
+	}
+	return nil
+}
+
+// isThreadReply reports whether the message is a reply not broadcasted to the channel.
+func isThreadReply(ev *slackevents.MessageEvent) bool {
+	return ev.ThreadTimeStamp != "" && ev.ThreadTimeStamp != ev.TimeStamp && ev.SubType != slack.MsgSubTypeThreadBroadcast
+}
+
+// mirrorThreadParent returns the mirrored parent of the thread, or posts a stub parent if not mirrored.
+func (agg *Aggregator) mirrorThreadParent(ctx context.Context, src *slackevents.MessageEvent, dstChannel string) (Mirror, error) {
+	mirrors, err := agg.Mirrors.Get(ctx, src.Channel, src.ThreadTimeStamp)
+	if err != nil {
+		return Mirror{}, fmt.Errorf("cannot lookup mirrored parent:%w", err)
+	}
+
+	if parent, ok := findMirror(mirrors, dstChannel); ok {
+		return parent, nil
+	}
+
+	parentLink, err := agg.ChannelInfo.GetMessageLink(ctx, &slackevents.MessageEvent{Channel: src.Channel, ChannelType: src.ChannelType, TimeStamp: src.ThreadTimeStamp})
+	if err != nil {
+		return Mirror{}, fmt.Errorf("cannot resolve cnannel name(genLink):%w", err)
+	}
+
+	// the stub is an extra post to the destination.
+	if err := waitToken(ctx); err != nil {
+		return Mirror{}, err
+	}
+	_, ts, err := postMessageWithRetry(ctx, agg.API, dstChannel,
+		slack.MsgOptionText(parentLink+" (thread)", false), slack.MsgOptionDisableLinkUnfurl())
+	if err != nil {
+		return Mirror{}, fmt.Errorf("cannot post stub parent:%w", err)
+	}
+
+	parent := Mirror{Channel: dstChannel, TimeStamp: ts}
+	if err := agg.Mirrors.Add(ctx, src.Channel, src.ThreadTimeStamp, parent); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot save mirrored message:%v\n", err)
+	}
+
+	return parent, nil
+}
+
+// messageDeletedHandler deletes mirrored copies or replaces them with placeholders.
+// mirrors are looked up on delivery since the copy may still be queued.
+func (agg *Aggregator) messageDeletedHandler(ctx context.Context, ev *slackevents.MessageEvent) error {
+	if ev.PreviousMessage == nil {
+		return nil
+	}
+
+	src := &slackevents.MessageEvent{}
+	*src = *ev.PreviousMessage
+	src.Channel = ev.Channel
+	src.ChannelType = ev.ChannelType
+
+	// pending digests must not show deleted messages.
+	if agg.Digests != nil {
+		if err := agg.removeDigest(ctx, src.Channel, src.TimeStamp); err != nil {
+			return err
+		}
+	}
+
+	dstChannels, err := agg.deletedDestinations(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	if len(dstChannels) == 0 {
+		return nil
+	}
+
+	msgLink, err := agg.ChannelInfo.GetMessageLink(ctx, src)
+	if err != nil {
+		return fmt.Errorf("cannot resolve cnannel name(genLink):%w", err)
+	}
+
+	var errs []string
+	for _, dstChannel := range dstChannels {
+		if agg.Dispatcher.Destination(dstChannel).OnDelete == onDeleteKeep {
+			continue
+		}
+
+		msg := &OutboxMessage{
+			Op:          OutboxOpDelete,
+			Dst:         dstChannel,
+			Channel:     src.Channel,
+			ChannelType: src.ChannelType,
+			TimeStamp:   src.TimeStamp,
+			Text:        msgLink + " (deleted)",
+		}
+		if err := agg.enqueue(ctx, msg); err != nil {
+			errs = append(errs, fmt.Sprintf("(dst=%s):%v", dstChannel, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("mirror deletion err:%s", strings.Join(errs, ","))
+	}
+	return nil
+}
+
+// deletedDestinations returns channels where the deleted message was mirrored or may be queued.
+func (agg *Aggregator) deletedDestinations(ctx context.Context, src *slackevents.MessageEvent) ([]string, error) {
+	mirrors, err := agg.Mirrors.Get(ctx, src.Channel, src.TimeStamp)
+	if err != nil {
+		return nil, fmt.Errorf("cannot lookup mirrored messages:%w", err)
+	}
+
+	var dstChannels []string
+	for _, mirror := range mirrors {
+		dstChannels = appendDestination(dstChannels, mirror.Channel)
+	}
+
+	if src.User == "" {
+		return dstChannels, nil
+	}
+
+	prof, err := agg.authorProfile(ctx, src.User, src.UserTeam)
+	if err != nil {
+		return nil, err
+	}
+	if prof.IsBots() {
+		return dstChannels, nil
+	}
+
+	resolvedText, err := agg.UserInfo.ReplaceMentionUIDs(ctx, src.Text)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve mentions:%w", err)
+	}
+
+	rc, err := agg.routeContext(ctx, src, src.User, prof, resolvedText)
+	if err != nil {
+		return nil, err
+	}
+
+	return appendDestinations(dstChannels, agg.Dispatcher.Dispatch(rc)...), nil
+}
+
+func (agg *Aggregator) channelRenameNotice(ctx context.Context, cid, oldName, newName string) error {
+	oldDsts := agg.Dispatcher.Dispatch(&RouteContext{ChannelID: cid, ChannelName: oldName})
+	newDsts := agg.Dispatcher.Dispatch(&RouteContext{ChannelID: cid, ChannelName: newName})
+	if sameDestinations(oldDsts, newDsts) {
+		return nil
+	}
+
+	msg := fmt.Sprintf("channel `#%s` was renamed to <#%s|%s>. destination changed:%s -> %s",
+		oldName, cid, newName, destinationLinks(oldDsts), destinationLinks(newDsts))
+
+	var errs []string
+	for _, dstChannel := range appendDestinations(append([]string{}, oldDsts...), newDsts...) {
+		if !agg.Dispatcher.Destination(dstChannel).RenameNotice {
+			continue
+		}
+		err := agg.enqueue(ctx, &OutboxMessage{Op: OutboxOpNotice, Dst: dstChannel, Channel: cid, Text: msg})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("(dst=%s):%v", dstChannel, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("rename notice err:%s", strings.Join(errs, ","))
+	}
+
+	return nil
+}
+
+func sameDestinations(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, v := range b {
+		if !containsDestination(a, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func destinationLinks(dsts []string) string {
+	if len(dsts) == 0 {
+		return "(none)"
+	}
+
+	links := make([]string, 0, len(dsts))
+	for _, v := range dsts {
+		links = append(links, fmt.Sprintf("<#%s>", v))
+	}
+	return strings.Join(links, ",")
+}
@@ -0,0 +1,158 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// team.info accepting the team parameter. slack-go does not support it.
+const (
+	teamInfoUrl     = "https://slack.com/api/team.info"
+	teamInfoTimeout = 10 * time.Second
+)
+
+// TeamInfoClient calls team.info with the bot token.
+type TeamInfoClient struct {
+	token string
+	http  *http.Client
+}
+
+func NewTeamInfoClient(token string, client *http.Client) *TeamInfoClient {
+	if client == nil {
+		client = &http.Client{Timeout: teamInfoTimeout}
+	}
+	return &TeamInfoClient{token: token, http: client}
+}
+
+// homeTeam is the workspace(and the organization of Enterprise Grid) the app is installed.
+type homeTeam struct {
+	teamId       string
+	enterpriseId string
+}
+
+// getHomeTeam returns the workspace of the app. nil if unknown.
+func (info *UserInfo) getHomeTeam(ctx context.Context) *homeTeam {
+	var home *homeTeam
+	func() {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		home = info.home
+	}()
+
+	if home != nil || info.api == nil {
+		return home
+	}
+
+	resp, err := info.api.AuthTestContext(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot get home team:%v\n", err)
+		return nil
+	}
+
+	home = &homeTeam{teamId: resp.TeamID, enterpriseId: resp.EnterpriseID}
+	func() {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		info.home = home
+	}()
+
+	return home
+}
+
+// isExternal reports whether the team(and the organization) differs from the home team.
+func (home *homeTeam) isExternal(teamId, enterpriseId string) bool {
+	if home == nil || teamId == "" || teamId == home.teamId {
+		return false
+	}
+	return home.enterpriseId == "" || enterpriseId != home.enterpriseId
+}
+
+// setExternal labels the profile of an external user with the organization name.
+func (info *UserInfo) setExternal(ctx context.Context, prof *UserProfile, stranger bool, enterpriseId, enterpriseName string) {
+	if !stranger && !info.getHomeTeam(ctx).isExternal(prof.TeamID, enterpriseId) {
+		return
+	}
+
+	prof.External = true
+	prof.Org = enterpriseName
+	if prof.Org == "" && prof.TeamID != "" {
+		prof.Org = info.getTeamName(ctx, prof.TeamID)
+	}
+}
+
+// externalProfile is used for users whose profile is not visible to the app.
+func (info *UserInfo) externalProfile(ctx context.Context, uid, teamId string) *UserProfile {
+	prof := &UserProfile{Name: uid, TeamID: teamId}
+	info.setExternal(ctx, prof, false, "", "")
+	return prof
+}
+
+// getTeamName returns the name of the team. the team ID is returned if unknown.
+func (info *UserInfo) getTeamName(ctx context.Context, teamId string) string {
+	var name string
+	ok := false
+	func() {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		name, ok = info.teams[teamId]
+	}()
+
+	if ok {
+		return name
+	}
+
+	if info.teamInfo == nil {
+		return teamId
+	}
+
+	name, err := info.teamInfo.lookupTeamName(ctx, teamId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot get team name(team=%s):%v\n", teamId, err)
+		return teamId
+	}
+
+	func() {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		info.teams[teamId] = name
+	}()
+
+	return name
+}
+
+func (c *TeamInfoClient) lookupTeamName(ctx context.Context, teamId string) (string, error) {
+	values := url.Values{"team": {teamId}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, teamInfoUrl, strings.NewReader(values.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("err at team.info:%w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		slack.SlackResponse
+		Team slack.TeamInfo `json:"team"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("err at team.info:%w", err)
+	}
+	if err := result.Err(); err != nil {
+		return "", fmt.Errorf("err at team.info:%w", err)
+	}
+
+	return result.Team.Name, nil
+}
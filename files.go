@@ -0,0 +1,98 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+)
+
+// file modes without contents to show.
+const (
+	fileModeTombstone     = "tombstone"
+	fileModeHiddenByLimit = "hidden_by_limit"
+)
+
+// fileLines describes shared files as mrkdwn lines.
+func fileLines(files []slackevents.File) []string {
+	lines := make([]string, 0, len(files))
+	for _, file := range files {
+		lines = append(lines, fileLine(&file))
+	}
+	return lines
+}
+
+func fileLine(file *slackevents.File) string {
+	if file.Mode == fileModeTombstone || file.Mode == fileModeHiddenByLimit {
+		return ":paperclip: (unavailable file)"
+	}
+
+	name := file.Title
+	if name == "" {
+		name = file.Name
+	}
+	name = escapeMrkdwn(name)
+	if file.Permalink != "" {
+		name = fmt.Sprintf("<%s|%s>", file.Permalink, name)
+	}
+
+	var details []string
+	if file.PrettyType != "" {
+		details = append(details, file.PrettyType)
+	} else if file.Filetype != "" {
+		details = append(details, file.Filetype)
+	}
+	if file.Size > 0 {
+		details = append(details, formatFileSize(file.Size))
+	}
+
+	if len(details) == 0 {
+		return ":paperclip: " + name
+	}
+	return fmt.Sprintf(":paperclip: %s (%s)", name, strings.Join(details, ", "))
+}
+
+// fileBlocks renders shared files. images are shown as slack_file images,
+// which slack rejects unless the bot can see the file.
+func fileBlocks(files []slackevents.File) []slack.Block {
+	blocks := []slack.Block{mrkdwnSection(strings.Join(fileLines(files), "\n"))}
+	for _, file := range files {
+		if file.Mode == fileModeTombstone || file.Mode == fileModeHiddenByLimit || file.IsExternal {
+			continue
+		}
+		if !strings.HasPrefix(file.Mimetype, "image/") || file.Thumb360 == "" {
+			continue
+		}
+
+		altText := file.Title
+		if altText == "" {
+			altText = file.Name
+		}
+		blocks = append(blocks, rawBlock{
+			"type":       "image",
+			"slack_file": map[string]interface{}{"id": file.ID},
+			"alt_text":   altText,
+		})
+	}
+	return blocks
+}
+
+func formatFileSize(size int) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := unit, 0
+	for n := size / unit; n >= unit && exp < 3; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGT"[exp])
+}
+
+// escapeMrkdwn escapes control characters of mrkdwn.
+func escapeMrkdwn(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
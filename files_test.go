@@ -0,0 +1,29 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/slack-go/slack/slackevents"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileLines(t *testing.T) {
+	files := []slackevents.File{
+		{ID: "F1", Name: "a<b>.png", Mimetype: "image/png", PrettyType: "PNG", Size: 1536, Permalink: "https://example.com/F1", Thumb360: "https://example.com/F1_360"},
+		{ID: "F2", Name: "memo.txt", Filetype: "text", Size: 12},
+		{ID: "F3", Mode: fileModeTombstone},
+	}
+
+	assert.Equal(t, []string{
+		":paperclip: <https://example.com/F1|a&lt;b&gt;.png> (PNG, 1.5 KB)",
+		":paperclip: memo.txt (text, 12 B)",
+		":paperclip: (unavailable file)",
+	}, fileLines(files))
+
+	// the list and the image of F1.
+	blocks := fileBlocks(files)
+	assert.Len(t, blocks, 2)
+	assert.Equal(t, map[string]interface{}{"id": "F1"}, blocks[1].(rawBlock)["slack_file"])
+
+	assert.Equal(t, "3.0 MB", formatFileSize(3*1024*1024))
+}
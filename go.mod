@@ -1,12 +1,22 @@
 module github.com/walkure/aggrechans
 
-go 1.16
+go 1.18
 
 require (
-	github.com/go-redis/redis/v8 v8.11.4 // indirect
-	github.com/slack-go/slack v0.10.0 // indirect
-	github.com/stretchr/testify v1.7.0 // indirect
+	github.com/go-redis/redis/v8 v8.11.4
+	github.com/slack-go/slack v0.10.0
+	github.com/stretchr/testify v1.7.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-// +heroku goVersion go1.16
+require (
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/gorilla/websocket v1.4.2 // indirect
+	github.com/pkg/errors v0.8.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+)
+
+// +heroku goVersion go1.18
 // +heroku install ./webhook/
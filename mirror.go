@@ -0,0 +1,163 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	redisMirrorPrefix = "aggrechans:mirror:v1:"
+	// mirrored messages older than this are forgotten.
+	mirrorTTL = 7 * 24 * time.Hour
+)
+
+// Mirror is a copy of a source message posted to a destination channel.
+type Mirror struct {
+	Channel   string
+	TimeStamp string
+}
+
+// MirrorStore records which messages are mirrored where.
+type MirrorStore interface {
+	Add(ctx context.Context, srcChannel, srcTimeStamp string, mirror Mirror) error
+	Get(ctx context.Context, srcChannel, srcTimeStamp string) ([]Mirror, error)
+	// Delete forgets the mirror in the destination channel.
+	Delete(ctx context.Context, srcChannel, srcTimeStamp, dstChannel string) error
+}
+
+// NewMirrorStore returns a store backed by Redis, or memory if redis is nil.
+func NewMirrorStore(redis *redis.Client) MirrorStore {
+	if redis != nil {
+		return &redisMirrorStore{redis: redis}
+	}
+	return &memoryMirrorStore{mirrors: make(map[string]*memoryMirrors)}
+}
+
+func mirrorKey(srcChannel, srcTimeStamp string) string {
+	return fmt.Sprintf("%s%s:%s", redisMirrorPrefix, srcChannel, srcTimeStamp)
+}
+
+func findMirror(mirrors []Mirror, channel string) (Mirror, bool) {
+	for _, v := range mirrors {
+		if v.Channel == channel {
+			return v, true
+		}
+	}
+	return Mirror{}, false
+}
+
+// redisMirrorStore keeps mirrors as a hash(destination channel -> timestamp).
+type redisMirrorStore struct {
+	redis *redis.Client
+}
+
+func (s *redisMirrorStore) Add(ctx context.Context, srcChannel, srcTimeStamp string, mirror Mirror) error {
+	key := mirrorKey(srcChannel, srcTimeStamp)
+
+	_, err := s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, mirror.Channel, mirror.TimeStamp)
+		pipe.Expire(ctx, key, mirrorTTL)
+		return nil
+	})
+	return err
+}
+
+func (s *redisMirrorStore) Get(ctx context.Context, srcChannel, srcTimeStamp string) ([]Mirror, error) {
+	result, err := s.redis.HGetAll(ctx, mirrorKey(srcChannel, srcTimeStamp)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	mirrors := make([]Mirror, 0, len(result))
+	for k, v := range result {
+		mirrors = append(mirrors, Mirror{Channel: k, TimeStamp: v})
+	}
+	return mirrors, nil
+}
+
+func (s *redisMirrorStore) Delete(ctx context.Context, srcChannel, srcTimeStamp, dstChannel string) error {
+	return s.redis.HDel(ctx, mirrorKey(srcChannel, srcTimeStamp), dstChannel).Err()
+}
+
+type memoryMirrors struct {
+	mirrors []Mirror
+	expire  time.Time
+}
+
+type memoryMirrorStore struct {
+	mirrors map[string]*memoryMirrors
+	mu      sync.Mutex
+	// next time to purge expired mirrors
+	purgeAt time.Time
+}
+
+func (s *memoryMirrorStore) Add(ctx context.Context, srcChannel, srcTimeStamp string, mirror Mirror) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.After(s.purgeAt) {
+		for k, v := range s.mirrors {
+			if now.After(v.expire) {
+				delete(s.mirrors, k)
+			}
+		}
+		s.purgeAt = now.Add(time.Hour)
+	}
+
+	key := mirrorKey(srcChannel, srcTimeStamp)
+	entry, ok := s.mirrors[key]
+	if !ok {
+		entry = &memoryMirrors{}
+		s.mirrors[key] = entry
+	}
+	entry.expire = now.Add(mirrorTTL)
+
+	for i := range entry.mirrors {
+		if entry.mirrors[i].Channel == mirror.Channel {
+			entry.mirrors[i] = mirror
+			return nil
+		}
+	}
+	entry.mirrors = append(entry.mirrors, mirror)
+
+	return nil
+}
+
+func (s *memoryMirrorStore) Get(ctx context.Context, srcChannel, srcTimeStamp string) ([]Mirror, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.mirrors[mirrorKey(srcChannel, srcTimeStamp)]
+	if !ok || time.Now().After(entry.expire) {
+		return nil, nil
+	}
+
+	return append([]Mirror{}, entry.mirrors...), nil
+}
+
+func (s *memoryMirrorStore) Delete(ctx context.Context, srcChannel, srcTimeStamp, dstChannel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := mirrorKey(srcChannel, srcTimeStamp)
+	entry, ok := s.mirrors[key]
+	if !ok {
+		return nil
+	}
+
+	for i := range entry.mirrors {
+		if entry.mirrors[i].Channel == dstChannel {
+			entry.mirrors = append(entry.mirrors[:i], entry.mirrors[i+1:]...)
+			break
+		}
+	}
+	if len(entry.mirrors) == 0 {
+		delete(s.mirrors, key)
+	}
+	return nil
+}
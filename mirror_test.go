@@ -0,0 +1,42 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryMirrorStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMirrorStore(nil)
+
+	mirrors, err := s.Get(ctx, "CSRC", "1000.0001")
+	assert.Nil(t, err)
+	assert.Empty(t, mirrors)
+
+	assert.Nil(t, s.Add(ctx, "CSRC", "1000.0001", Mirror{Channel: "CDST1", TimeStamp: "2000.0001"}))
+	assert.Nil(t, s.Add(ctx, "CSRC", "1000.0001", Mirror{Channel: "CDST2", TimeStamp: "2000.0002"}))
+	assert.Nil(t, s.Add(ctx, "CSRC", "1000.0001", Mirror{Channel: "CDST1", TimeStamp: "2000.0003"}))
+
+	mirrors, err = s.Get(ctx, "CSRC", "1000.0001")
+	assert.Nil(t, err)
+	assert.Equal(t, []Mirror{{Channel: "CDST1", TimeStamp: "2000.0003"}, {Channel: "CDST2", TimeStamp: "2000.0002"}}, mirrors)
+
+	mirror, ok := findMirror(mirrors, "CDST2")
+	assert.True(t, ok)
+	assert.Equal(t, "2000.0002", mirror.TimeStamp)
+
+	_, ok = findMirror(mirrors, "CDST3")
+	assert.False(t, ok)
+
+	assert.Nil(t, s.Delete(ctx, "CSRC", "1000.0001", "CDST1"))
+	mirrors, err = s.Get(ctx, "CSRC", "1000.0001")
+	assert.Nil(t, err)
+	assert.Equal(t, []Mirror{{Channel: "CDST2", TimeStamp: "2000.0002"}}, mirrors)
+
+	assert.Nil(t, s.Delete(ctx, "CSRC", "1000.0001", "CDST2"))
+	mirrors, err = s.Get(ctx, "CSRC", "1000.0001")
+	assert.Nil(t, err)
+	assert.Empty(t, mirrors)
+}
@@ -0,0 +1,183 @@
+// Package mrkdwn parses Slack mrkdwn text into tokens.
+package mrkdwn
+
+import (
+	"strings"
+)
+
+type Kind int
+
+const (
+	// plain text
+	Text Kind = iota
+	// <@U123> or <@U123|name>
+	UserRef
+	// <#C123> or <#C123|name>
+	ChannelRef
+	// <!subteam^S123> or <!subteam^S123|@handle>
+	UserGroupRef
+	// <!here>, <!channel>, <!everyone> or <!group>
+	SpecialMention
+	// other <!...> such as <!date^...|fallback>
+	Command
+	// <https://example.com> or <https://example.com|label>
+	Link
+	// :emoji:
+	Emoji
+	// `code`
+	Code
+	// ```code block```
+	CodeBlock
+)
+
+var kindNames = []string{"Text", "UserRef", "ChannelRef", "UserGroupRef", "SpecialMention", "Command", "Link", "Emoji", "Code", "CodeBlock"}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return "Unknown"
+}
+
+// Token is a piece of mrkdwn text.
+type Token struct {
+	Kind Kind
+	// original text. joining Raw of all tokens gives the input.
+	Raw string
+	// ID of references, name of special mentions, commands and emojis,
+	// URL of links, or contents of code.
+	Value string
+	// text after the first '|' in angle brackets
+	Label string
+}
+
+// Tokenize splits the text into tokens. it never fails; broken markup is text.
+func Tokenize(s string) []Token {
+	var tokens []Token
+	text := 0 // start of the pending text
+
+	flush := func(end int) {
+		if text < end {
+			tokens = append(tokens, Token{Kind: Text, Raw: s[text:end], Value: s[text:end]})
+		}
+	}
+
+	for i := 0; i < len(s); {
+		tok, ok := Token{}, false
+		switch s[i] {
+		case '<':
+			tok, ok = parseAngle(s[i:])
+		case '`':
+			tok, ok = parseCode(s[i:])
+		case ':':
+			tok, ok = parseEmoji(s[i:])
+		}
+
+		if !ok {
+			i++
+			continue
+		}
+
+		flush(i)
+		tokens = append(tokens, tok)
+		i += len(tok.Raw)
+		text = i
+	}
+	flush(len(s))
+
+	return tokens
+}
+
+// Join concatenates Raw of the tokens.
+func Join(tokens []Token) string {
+	sb := strings.Builder{}
+	for _, tok := range tokens {
+		sb.WriteString(tok.Raw)
+	}
+	return sb.String()
+}
+
+// Rewrite replaces each token with the result of f.
+func Rewrite(s string, f func(tok Token) string) string {
+	sb := strings.Builder{}
+	for _, tok := range Tokenize(s) {
+		sb.WriteString(f(tok))
+	}
+	return sb.String()
+}
+
+var specialMentions = map[string]bool{"here": true, "channel": true, "everyone": true, "group": true}
+
+// parseAngle parses <...>. a '<' followed by another '<' before '>' is text.
+func parseAngle(s string) (Token, bool) {
+	end := strings.IndexAny(s[1:], "<>")
+	if end < 0 || s[1+end] != '>' {
+		return Token{}, false
+	}
+	raw := s[:end+2]
+	body := raw[1 : len(raw)-1]
+
+	target, label := body, ""
+	if sep := strings.IndexByte(body, '|'); sep >= 0 {
+		target, label = body[:sep], body[sep+1:]
+	}
+	if target == "" {
+		return Token{}, false
+	}
+
+	tok := Token{Raw: raw, Label: label}
+	switch target[0] {
+	case '@':
+		tok.Kind, tok.Value = UserRef, target[1:]
+	case '#':
+		tok.Kind, tok.Value = ChannelRef, target[1:]
+	case '!':
+		name := target[1:]
+		if strings.HasPrefix(name, "subteam^") {
+			tok.Kind, tok.Value = UserGroupRef, strings.TrimPrefix(name, "subteam^")
+		} else if specialMentions[name] {
+			tok.Kind, tok.Value = SpecialMention, name
+		} else {
+			tok.Kind, tok.Value = Command, name
+		}
+	default:
+		tok.Kind, tok.Value = Link, target
+	}
+
+	if tok.Kind != Link && tok.Kind != Command && tok.Value == "" {
+		return Token{}, false
+	}
+	return tok, true
+}
+
+// parseCode parses `code` in a line or ```code block```.
+func parseCode(s string) (Token, bool) {
+	if strings.HasPrefix(s, "```") {
+		end := strings.Index(s[3:], "```")
+		if end > 0 {
+			return Token{Kind: CodeBlock, Raw: s[:end+6], Value: s[3 : end+3]}, true
+		}
+	}
+
+	end := strings.IndexAny(s[1:], "`\n")
+	if end <= 0 || s[1+end] != '`' {
+		return Token{}, false
+	}
+	return Token{Kind: Code, Raw: s[:end+2], Value: s[1 : end+1]}, true
+}
+
+// parseEmoji parses :name: or :name::skin-tone-2:.
+func parseEmoji(s string) (Token, bool) {
+	end := 1
+	for end < len(s) && isEmojiNameByte(s[end]) {
+		end++
+	}
+	if end == 1 || end >= len(s) || s[end] != ':' {
+		return Token{}, false
+	}
+	return Token{Kind: Emoji, Raw: s[:end+1], Value: s[1:end]}, true
+}
+
+func isEmojiNameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '+' || c == '\''
+}
@@ -0,0 +1,96 @@
+package mrkdwn
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens := Tokenize("hi <@U123> <@W456|bob> in <#C789|general> <!subteam^S1|@eng> <!here> <!date^1392734382^{date}|Feb 18> <https://example.com|a|b> :wave: `<!here>` ```\n<@U1>\n```")
+	assert.Equal(t, []Token{
+		{Kind: Text, Raw: "hi ", Value: "hi "},
+		{Kind: UserRef, Raw: "<@U123>", Value: "U123"},
+		{Kind: Text, Raw: " ", Value: " "},
+		{Kind: UserRef, Raw: "<@W456|bob>", Value: "W456", Label: "bob"},
+		{Kind: Text, Raw: " in ", Value: " in "},
+		{Kind: ChannelRef, Raw: "<#C789|general>", Value: "C789", Label: "general"},
+		{Kind: Text, Raw: " ", Value: " "},
+		{Kind: UserGroupRef, Raw: "<!subteam^S1|@eng>", Value: "S1", Label: "@eng"},
+		{Kind: Text, Raw: " ", Value: " "},
+		{Kind: SpecialMention, Raw: "<!here>", Value: "here"},
+		{Kind: Text, Raw: " ", Value: " "},
+		{Kind: Command, Raw: "<!date^1392734382^{date}|Feb 18>", Value: "date^1392734382^{date}", Label: "Feb 18"},
+		{Kind: Text, Raw: " ", Value: " "},
+		{Kind: Link, Raw: "<https://example.com|a|b>", Value: "https://example.com", Label: "a|b"},
+		{Kind: Text, Raw: " ", Value: " "},
+		{Kind: Emoji, Raw: ":wave:", Value: "wave"},
+		{Kind: Text, Raw: " ", Value: " "},
+		{Kind: Code, Raw: "`<!here>`", Value: "<!here>"},
+		{Kind: Text, Raw: " ", Value: " "},
+		{Kind: CodeBlock, Raw: "```\n<@U1>\n```", Value: "\n<@U1>\n"},
+	}, tokens)
+}
+
+func TestTokenizeBroken(t *testing.T) {
+	// nested '<' is text.
+	assert.Equal(t, []Token{
+		{Kind: Text, Raw: "<", Value: "<"},
+		{Kind: UserRef, Raw: "<@U1>", Value: "U1"},
+	}, Tokenize("<<@U1>"))
+
+	for _, s := range []string{"<!here", "<>", "<@>", "a < b > c", "`", "``", "`a\nb`", "<|>", "::", ":a b:"} {
+		tokens := Tokenize(s)
+		assert.Equal(t, s, Join(tokens), s)
+		for _, tok := range tokens {
+			if s != "a < b > c" {
+				assert.Equal(t, Text, tok.Kind, s)
+			}
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	got := Rewrite("<@U1> says <!channel>", func(tok Token) string {
+		if tok.Kind == UserRef {
+			return "@" + strings.ToLower(tok.Value)
+		}
+		return tok.Raw
+	})
+	assert.Equal(t, "@u1 says <!channel>", got)
+}
+
+func FuzzTokenize(f *testing.F) {
+	for _, seed := range []string{
+		"hi <@U123|name> <#C1> <!subteam^S1|@eng> <!here>",
+		"<<@U1>>", "<!date^1|x|y>", "`code` ```block```", ":+1::skin-tone-2:", "<", "```", "日本語<@U1>",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		tokens := Tokenize(s)
+		if got := Join(tokens); got != s {
+			t.Fatalf("Join(Tokenize(%q)) = %q", s, got)
+		}
+
+		for i, tok := range tokens {
+			if tok.Raw == "" {
+				t.Fatalf("empty token in %q", s)
+			}
+			if tok.Kind == Text {
+				if i > 0 && tokens[i-1].Kind == Text {
+					t.Fatalf("adjacent text tokens in %q", s)
+				}
+				continue
+			}
+
+			// markup is parsed in the same way alone.
+			alone := Tokenize(tok.Raw)
+			if len(alone) != 1 || alone[0] != tok {
+				t.Fatalf("token %+v of %q is parsed as %+v", tok, s, alone)
+			}
+		}
+	})
+}
@@ -0,0 +1,228 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/slack-go/slack"
+)
+
+const (
+	// chat.postMessage allows about 1 message per second per channel with short bursts.
+	outboxRate  = 1.0
+	outboxBurst = 3
+)
+
+const (
+	// post a mirrored copy, or update it if already posted
+	OutboxOpMirror = "mirror"
+	// delete a mirrored copy or replace it with a placeholder
+	OutboxOpDelete = "delete"
+	// post a digest of messages
+	OutboxOpDigest = "digest"
+	// post a notice from the bot
+	OutboxOpNotice = "notice"
+)
+
+// OutboxMessage is an operation against a destination channel.
+type OutboxMessage struct {
+	Op  string `json:"op"`
+	Dst string `json:"dst"`
+
+	// the source message
+	Channel     string `json:"channel"`
+	ChannelType string `json:"channel_type,omitempty"`
+	TimeStamp   string `json:"ts"`
+	// set if posted as a thread reply under the mirrored parent
+	ThreadTimeStamp string `json:"thread_ts,omitempty"`
+	// update the mirrored copy if exists
+	Edited bool `json:"edited,omitempty"`
+
+	Username    string             `json:"username,omitempty"`
+	IconURL     string             `json:"icon_url,omitempty"`
+	Text        string             `json:"text"`
+	Blocks      json.RawMessage    `json:"blocks,omitempty"`
+	Attachments []slack.Attachment `json:"attachments,omitempty"`
+
+	// the mirrored copy to be deleted. looked up on delivery if nil
+	Mirror *Mirror `json:"mirror,omitempty"`
+}
+
+func (msg *OutboxMessage) blocks() ([]slack.Block, error) {
+	if len(msg.Blocks) == 0 {
+		return nil, nil
+	}
+
+	var raw []rawBlock
+	if err := json.Unmarshal(msg.Blocks, &raw); err != nil {
+		return nil, fmt.Errorf("invalid blocks:%w", err)
+	}
+
+	blocks := make([]slack.Block, 0, len(raw))
+	for _, v := range raw {
+		blocks = append(blocks, v)
+	}
+	return blocks, nil
+}
+
+func (msg *OutboxMessage) String() string {
+	return fmt.Sprintf("%s(src=%s:%s,dst=%s)", msg.Op, msg.Channel, msg.TimeStamp, msg.Dst)
+}
+
+// deliverFunc sends a queued message to Slack.
+type deliverFunc func(ctx context.Context, msg *OutboxMessage) error
+
+// Outbox queues messages per destination channel and sends them in order at a limited rate.
+type Outbox interface {
+	Push(ctx context.Context, msg *OutboxMessage) error
+	// Start runs workers passing queued messages to deliver until ctx is done.
+	Start(ctx context.Context, deliver deliverFunc)
+}
+
+var errOutboxNotStarted = errors.New("outbox not started")
+
+// NewOutbox returns an outbox backed by Redis lists, or memory if redis is nil.
+func NewOutbox(redis *redis.Client) Outbox {
+	if redis != nil {
+		return &redisOutbox{redis: redis, owner: outboxOwner(), workers: make(map[string]bool)}
+	}
+	return &memoryOutbox{queues: make(map[string]*memoryQueue)}
+}
+
+// tokenBucket allows burst operations at once and refills rate tokens per second.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait blocks until a token is available. not goroutine safe.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+
+		if b.tokens >= 1 {
+			b.tokens--
+			return nil
+		}
+
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+type tokenBucketKey struct{}
+
+// withTokenBucket lets the delivery take more tokens of the destination for extra posts.
+func withTokenBucket(ctx context.Context, b *tokenBucket) context.Context {
+	return context.WithValue(ctx, tokenBucketKey{}, b)
+}
+
+// waitToken takes a token of the destination being delivered. it does not wait outside outbox workers.
+func waitToken(ctx context.Context) error {
+	if b, ok := ctx.Value(tokenBucketKey{}).(*tokenBucket); ok {
+		return b.wait(ctx)
+	}
+	return nil
+}
+
+func logDeliverError(msg *OutboxMessage, err error) {
+	fmt.Fprintf(os.Stderr, "outbox %s failed:%v\n", msg, err)
+}
+
+// memoryOutbox loses queued messages on restart.
+type memoryOutbox struct {
+	queues  map[string]*memoryQueue
+	mu      sync.Mutex
+	ctx     context.Context
+	deliver deliverFunc
+}
+
+type memoryQueue struct {
+	msgs []*OutboxMessage
+	// notified when a message is pushed
+	wake chan struct{}
+}
+
+func (o *memoryOutbox) Start(ctx context.Context, deliver deliverFunc) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.ctx, o.deliver = ctx, deliver
+}
+
+func (o *memoryOutbox) Push(ctx context.Context, msg *OutboxMessage) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.deliver == nil {
+		return errOutboxNotStarted
+	}
+
+	q, ok := o.queues[msg.Dst]
+	if !ok {
+		q = &memoryQueue{wake: make(chan struct{}, 1)}
+		o.queues[msg.Dst] = q
+		go o.work(q)
+	}
+	q.msgs = append(q.msgs, msg)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (o *memoryOutbox) pop(q *memoryQueue) *OutboxMessage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(q.msgs) == 0 {
+		return nil
+	}
+	msg := q.msgs[0]
+	q.msgs = q.msgs[1:]
+	return msg
+}
+
+func (o *memoryOutbox) work(q *memoryQueue) {
+	bucket := newTokenBucket(outboxRate, outboxBurst)
+	for {
+		msg := o.pop(q)
+		if msg == nil {
+			select {
+			case <-o.ctx.Done():
+				return
+			case <-q.wake:
+				continue
+			}
+		}
+
+		if err := bucket.wait(o.ctx); err != nil {
+			return
+		}
+		if err := o.deliver(withTokenBucket(o.ctx, bucket), msg); err != nil {
+			logDeliverError(msg, err)
+		}
+	}
+}
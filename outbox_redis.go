@@ -0,0 +1,285 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// set of destination channels which have queues
+	redisOutboxDestsKey = "aggrechans:outbox:v1:dests"
+	redisOutboxPrefix   = "aggrechans:outbox:v1:"
+	// a worker holds the lock of the destination to keep the order and the rate among replicas.
+	redisOutboxLockTTL = 30 * time.Second
+	// blocking pop timeout. the lock is refreshed at least this interval.
+	redisOutboxPopTimeout = 5 * time.Second
+	// find queues created by other replicas
+	redisOutboxScanInterval = time.Minute
+	// a worker of an empty queue stops after this
+	redisOutboxIdleTimeout = time.Minute
+)
+
+// forgets the destination only if nothing is queued. Push adds it again in the same transaction as the message.
+var redisOutboxForgetScript = redis.NewScript(`
+if redis.call("LLEN", KEYS[2]) == 0 and redis.call("LLEN", KEYS[3]) == 0 then
+	return redis.call("SREM", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// redisOutbox keeps queued messages in Redis lists so they survive restarts.
+// messages are pushed to the head and popped from the tail into the processing list
+// which is pushed back on the next start if the process dies while delivering.
+type redisOutbox struct {
+	redis *redis.Client
+	// lock owner ID of this process
+	owner   string
+	workers map[string]bool
+	mu      sync.Mutex
+	ctx     context.Context
+	deliver deliverFunc
+}
+
+func outboxOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().UnixNano())
+}
+
+func redisOutboxKey(dst string) string {
+	return redisOutboxPrefix + dst
+}
+
+func (o *redisOutbox) Start(ctx context.Context, deliver deliverFunc) {
+	func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.ctx, o.deliver = ctx, deliver
+	}()
+
+	go func() {
+		ticker := time.NewTicker(redisOutboxScanInterval)
+		defer ticker.Stop()
+		for {
+			o.scan(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (o *redisOutbox) scan(ctx context.Context) {
+	dsts, err := o.redis.SMembers(ctx, redisOutboxDestsKey).Result()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot load outbox destinations:%v\n", err)
+		return
+	}
+	for _, dst := range dsts {
+		o.startWorker(dst)
+	}
+}
+
+func (o *redisOutbox) Push(ctx context.Context, msg *OutboxMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("cannot marshal outbox message:%w", err)
+	}
+
+	_, err = o.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, redisOutboxDestsKey, msg.Dst)
+		pipe.LPush(ctx, redisOutboxKey(msg.Dst), data)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot push outbox message:%w", err)
+	}
+
+	o.startWorker(msg.Dst)
+	return nil
+}
+
+func (o *redisOutbox) startWorker(dst string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.deliver == nil || o.workers[dst] {
+		return
+	}
+	o.workers[dst] = true
+	go func(ctx context.Context) {
+		o.work(ctx, dst)
+
+		func() {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			delete(o.workers, dst)
+		}()
+		// a message pushed while stopping is picked up here.
+		if ctx.Err() == nil && o.redis.LLen(ctx, redisOutboxKey(dst)).Val() > 0 {
+			o.startWorker(dst)
+		}
+	}(o.ctx)
+}
+
+func (o *redisOutbox) work(ctx context.Context, dst string) {
+	key := redisOutboxKey(dst)
+	processing := key + ":processing"
+	lock := key + ":lock"
+
+	bucket := newTokenBucket(outboxRate, outboxBurst)
+	locked := false
+	idleSince := time.Now()
+	defer func() {
+		if locked {
+			o.unlock(context.Background(), lock)
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if !locked {
+			ok, err := o.redis.SetNX(ctx, lock, o.owner, redisOutboxLockTTL).Result()
+			if err == nil && !ok && !o.redis.SIsMember(ctx, redisOutboxDestsKey, dst).Val() {
+				// the replica working on it has emptied the queue.
+				return
+			}
+			if err != nil || !ok {
+				// another replica is working.
+				sleepContext(ctx, redisOutboxPopTimeout)
+				continue
+			}
+			locked = true
+			if err := o.recover(ctx, key, processing); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot recover outbox(dst=%s):%v\n", dst, err)
+			}
+		} else if locked = o.refresh(ctx, lock); !locked {
+			fmt.Fprintf(os.Stderr, "outbox lock(dst=%s) lost\n", dst)
+			continue
+		}
+
+		data, err := o.redis.BRPopLPush(ctx, key, processing, redisOutboxPopTimeout).Result()
+		if errors.Is(err, redis.Nil) {
+			if time.Since(idleSince) >= redisOutboxIdleTimeout && o.forget(ctx, dst, key, processing) {
+				return
+			}
+			continue
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot pop outbox(dst=%s):%v\n", dst, err)
+			sleepContext(ctx, redisOutboxPopTimeout)
+			continue
+		}
+
+		if err := bucket.wait(ctx); err != nil {
+			// left in the processing list until the next start.
+			return
+		}
+
+		idleSince = time.Now()
+		msg := &OutboxMessage{}
+		if err := json.Unmarshal([]byte(data), msg); err != nil {
+			fmt.Fprintf(os.Stderr, "broken outbox message(dst=%s):%v\n", dst, err)
+		} else if err := o.deliverLocked(withTokenBucket(ctx, bucket), lock, msg); err != nil {
+			if ctx.Err() != nil {
+				// interrupted by shutdown. delivered again on the next start.
+				return
+			}
+			logDeliverError(msg, err)
+		}
+
+		// removed before checking the lock so that another replica does not recover the delivered message.
+		if err := o.redis.LRem(context.Background(), processing, 1, data).Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot remove processed outbox message(dst=%s):%v\n", dst, err)
+		}
+
+		if locked = o.refresh(ctx, lock); !locked {
+			fmt.Fprintf(os.Stderr, "outbox lock(dst=%s) lost while delivering\n", dst)
+		}
+	}
+}
+
+// forget removes the destination from the set if its queue is empty.
+func (o *redisOutbox) forget(ctx context.Context, dst, key, processing string) bool {
+	n, err := redisOutboxForgetScript.Run(ctx, o.redis, []string{redisOutboxDestsKey, key, processing}, dst).Int()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot forget outbox destination(dst=%s):%v\n", dst, err)
+		return false
+	}
+	return n > 0
+}
+
+// deliverLocked keeps the lock alive while delivering, which may take minutes with retries.
+// the delivery is canceled if the lock is lost.
+func (o *redisOutbox) deliverLocked(ctx context.Context, lock string, msg *OutboxMessage) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		ticker := time.NewTicker(redisOutboxLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !o.refresh(ctx, lock) {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return o.deliver(ctx, msg)
+}
+
+// recover pushes messages left in the processing list back to the tail of the queue.
+func (o *redisOutbox) recover(ctx context.Context, key, processing string) error {
+	left, err := o.redis.LRange(ctx, processing, 0, -1).Result()
+	if err != nil || len(left) == 0 {
+		return err
+	}
+
+	// the processing list has the oldest message at the tail like the queue.
+	values := make([]interface{}, 0, len(left))
+	for _, v := range left {
+		values = append(values, v)
+	}
+
+	_, err = o.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, values...)
+		pipe.Del(ctx, processing)
+		return nil
+	})
+	return err
+}
+
+// refresh extends the lock if still held.
+func (o *redisOutbox) refresh(ctx context.Context, lock string) bool {
+	owner, err := o.redis.Get(ctx, lock).Result()
+	if err != nil || owner != o.owner {
+		return false
+	}
+	return o.redis.Expire(ctx, lock, redisOutboxLockTTL).Err() == nil
+}
+
+func (o *redisOutbox) unlock(ctx context.Context, lock string) {
+	owner, err := o.redis.Get(ctx, lock).Result()
+	if err == nil && owner == o.owner {
+		o.redis.Del(ctx, lock)
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
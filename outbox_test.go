@@ -0,0 +1,78 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryOutbox(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o := NewOutbox(nil)
+	assert.Equal(t, errOutboxNotStarted, o.Push(ctx, &OutboxMessage{Dst: "CDST1"}))
+
+	var mu sync.Mutex
+	delivered := map[string][]string{}
+	done := make(chan struct{}, 6)
+	o.Start(ctx, func(ctx context.Context, msg *OutboxMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[msg.Dst] = append(delivered[msg.Dst], msg.TimeStamp)
+		done <- struct{}{}
+		return nil
+	})
+
+	for _, ts := range []string{"1", "2", "3"} {
+		assert.Nil(t, o.Push(ctx, &OutboxMessage{Dst: "CDST1", TimeStamp: ts}))
+		assert.Nil(t, o.Push(ctx, &OutboxMessage{Dst: "CDST2", TimeStamp: ts}))
+	}
+
+	for i := 0; i < 6; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("outbox stalled")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string][]string{"CDST1": {"1", "2", "3"}, "CDST2": {"1", "2", "3"}}, delivered)
+}
+
+func TestTokenBucket(t *testing.T) {
+	ctx := context.Background()
+	b := newTokenBucket(20, 2)
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, b.wait(ctx))
+	}
+	// 2 tokens at once and 2 more at 20/sec
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 90*time.Millisecond, elapsed)
+	assert.True(t, elapsed < time.Second, elapsed)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.NotNil(t, b.wait(ctx))
+}
+
+func TestWaitToken(t *testing.T) {
+	// outside outbox workers
+	assert.Nil(t, waitToken(context.Background()))
+
+	b := newTokenBucket(1, 1)
+	ctx := withTokenBucket(context.Background(), b)
+	assert.Nil(t, waitToken(ctx))
+
+	// the token is taken from the bucket of the delivery
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.NotNil(t, waitToken(ctx))
+}
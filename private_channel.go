@@ -0,0 +1,45 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// channel types of message events from private conversations.
+const (
+	channelTypePrivate = "group"
+	channelTypeMpim    = "mpim"
+	channelTypeIm      = "im"
+)
+
+// lock marker prepended to links of private channels.
+const privateChannelMarker = "🔒"
+
+func isPrivateChannelType(channelType string) bool {
+	return channelType == channelTypePrivate || channelType == channelTypeMpim
+}
+
+// privateChannels is the allow-list of private channels(and multi-party DMs)
+// whose messages are forwarded.
+type privateChannels []string
+
+// loadEnvPrivateChannels reads PRIVATE_CHANNEL_IDS separated by comma.
+func loadEnvPrivateChannels() privateChannels {
+	var p privateChannels
+	for _, cid := range strings.Split(os.Getenv("PRIVATE_CHANNEL_IDS"), ",") {
+		if cid = strings.TrimSpace(cid); cid != "" {
+			p = append(p, cid)
+		}
+	}
+	return p
+}
+
+// allows reports whether the message may be forwarded. public channels are always allowed.
+func (p privateChannels) allows(rc *RouteContext) bool {
+	return !rc.Private || containsDestination(p, rc.ChannelID)
+}
+
+func (p privateChannels) String() string {
+	return fmt.Sprintf("private[%s]", strings.Join(p, ","))
+}
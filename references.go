@@ -0,0 +1,49 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/walkure/aggrechans/mrkdwn"
+)
+
+// resolveReferences rewrites channel references into #name and user group mentions into ＠handle.
+// names of private channels not in the allow-list are not revealed.
+func (agg *Aggregator) resolveReferences(ctx context.Context, text string) string {
+	return rewriteText(text, func(tok mrkdwn.Token) (string, bool) {
+		switch tok.Kind {
+		case mrkdwn.ChannelRef:
+			if agg.ChannelInfo.isPrivate(ctx, tok.Value) && !agg.Dispatcher.AllowsPrivate(tok.Value) {
+				return "", false
+			}
+			name, err := agg.ChannelInfo.GetName(ctx, tok.Value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot resolve channel reference:%v\n", err)
+				name = fallbackLabel(tok.Label, tok.Value)
+			}
+			return "#" + name, true
+		case mrkdwn.UserGroupRef:
+			return "＠" + agg.userGroupHandle(ctx, tok.Value, tok.Label), true
+		}
+		return "", false
+	})
+}
+
+// userGroupHandle returns the handle of the user group, or the label if unknown.
+func (agg *Aggregator) userGroupHandle(ctx context.Context, gid, label string) string {
+	handle, err := agg.UserInfo.GetUserGroupHandle(ctx, gid)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot resolve usergroup reference:%v\n", err)
+		return fallbackLabel(strings.TrimPrefix(label, "@"), gid)
+	}
+	return handle
+}
+
+func fallbackLabel(label, id string) string {
+	if label != "" {
+		return label
+	}
+	return id
+}
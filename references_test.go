@@ -0,0 +1,30 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveReferences(t *testing.T) {
+	ui := CreateUserInfo(nil, nil, nil)
+	ui.handles = &userGroupHandles{handles: map[string]string{"S123": "eng", "SGONE": ""}, expire: time.Now().Add(time.Minute)}
+	agg := &Aggregator{
+		ChannelInfo: &ChannelInfo{
+			name:    map[string]string{"C123": "general", "G456": "secret", "G789": "allowed"},
+			private: map[string]bool{"C123": false, "G456": true, "G789": true},
+		},
+		UserInfo:   ui,
+		Dispatcher: simpleDispatcher{chanId: "CIDFIREHOSE", private: privateChannels{"G789"}},
+	}
+
+	ctx := context.Background()
+	assert.Equal(t, "see #general and #general", agg.resolveReferences(ctx, "see <#C123> and <#C123|old-name>"))
+	// names of private channels are left to Slack which shows them to members only
+	assert.Equal(t, "see <#G456> and #allowed", agg.resolveReferences(ctx, "see <#G456> and <#G789>"))
+	assert.Equal(t, "see <#CUNKNOWN|maybe-private>", agg.resolveReferences(ctx, "see <#CUNKNOWN|maybe-private>"))
+	assert.Equal(t, "cc ＠eng ＠eng", agg.resolveReferences(ctx, "cc <!subteam^S123> <!subteam^S123|@eng>"))
+	assert.Equal(t, "cc ＠old ＠SGONE", agg.resolveReferences(ctx, "cc <!subteam^SGONE|@old> <!subteam^SGONE>"))
+}
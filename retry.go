@@ -0,0 +1,92 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+const (
+	retryBaseDelay = time.Second
+	retryMaxDelay  = time.Minute
+	// give up transient failures after this
+	retryMaxAttempts = 6
+)
+
+// slack API errors which may succeed on retry.
+var transientSlackErrors = map[string]bool{
+	"internal_error":      true,
+	"fatal_error":         true,
+	"service_unavailable": true,
+	"request_timeout":     true,
+	"ratelimited":         true,
+}
+
+// isTransient reports whether the error may succeed on retry.
+// 5xx, timeouts and connection resets are transient. others such as channel_not_found are permanent.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var retryable interface{ Retryable() bool }
+	if errors.As(err, &retryable) {
+		return retryable.Retryable()
+	}
+
+	var slackErr slack.SlackErrorResponse
+	if errors.As(err, &slackErr) {
+		return transientSlackErrors[slackErr.Err]
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// backoff returns the delay before the attempt(0-origin) with full jitter.
+func backoff(attempt int) time.Duration {
+	d := retryBaseDelay << attempt
+	if d <= 0 || d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// withRetry calls f until it succeeds, fails permanently or gives up.
+// rate limited calls wait as slack says and are not counted as attempts.
+func withRetry(ctx context.Context, f func() error) error {
+	for attempt := 0; ; {
+		err := f()
+		if err == nil {
+			return nil
+		}
+
+		var wait time.Duration
+		var rateLimitedError *slack.RateLimitedError
+		if errors.As(err, &rateLimitedError) {
+			wait = rateLimitedError.RetryAfter
+		} else if isTransient(err) && attempt+1 < retryMaxAttempts {
+			wait = backoff(attempt)
+			attempt++
+		} else {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+)
+
+type statusCodeError int
+
+func (e statusCodeError) Error() string       { return fmt.Sprintf("status %d", int(e)) }
+func (e statusCodeError) HTTPStatusCode() int { return int(e) }
+func (e statusCodeError) Retryable() bool     { return int(e) >= 500 }
+
+func TestIsTransient(t *testing.T) {
+	assert.True(t, isTransient(statusCodeError(503)))
+	assert.False(t, isTransient(statusCodeError(404)))
+	assert.True(t, isTransient(fmt.Errorf("post:%w", syscall.ECONNRESET)))
+	assert.True(t, isTransient(io.ErrUnexpectedEOF))
+	assert.True(t, isTransient(slack.SlackErrorResponse{Err: "internal_error"}))
+	assert.False(t, isTransient(slack.SlackErrorResponse{Err: "channel_not_found"}))
+	assert.False(t, isTransient(errors.New("not_in_channel")))
+	assert.False(t, isTransient(context.Canceled))
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		d := backoff(attempt)
+		assert.True(t, d > 0, d)
+		assert.True(t, d <= retryMaxDelay, d)
+		if attempt < 6 {
+			assert.True(t, d <= retryBaseDelay<<attempt, d)
+		}
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	ctx := context.Background()
+
+	calls := 0
+	err := withRetry(ctx, func() error {
+		calls++
+		return slack.SlackErrorResponse{Err: "channel_not_found"}
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	err = withRetry(ctx, func() error {
+		calls++
+		if calls < 3 {
+			return &slack.RateLimitedError{RetryAfter: time.Millisecond}
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/slack-go/slack"
+	common "github.com/walkure/aggrechans"
+)
+
+// dry-run dispatch rules.
+//
+//	route [-user UID] [-text TEXT] channel_name...
+//	route -channels conversations.list.json
+func main() {
+	channelsFile := flag.String("channels", "", "JSON file saved from conversations.list")
+	uid := flag.String("user", "", "user ID of the message author")
+	text := flag.String("text", "", "message text")
+	useRedis := flag.Bool("redis", false, "use dispatch rules stored in Redis")
+	flag.Parse()
+
+	dispatcher, err := loadDispatcher(*useRedis)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot load dispatch info:%v\n", err)
+		os.Exit(-1)
+	}
+
+	chans := []slack.Channel{}
+	if *channelsFile != "" {
+		chans, err = loadChannelList(*channelsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot load channel list:%v\n", err)
+			os.Exit(-1)
+		}
+	}
+	for _, name := range flag.Args() {
+		chans = append(chans, slack.Channel{GroupConversation: slack.GroupConversation{Name: name}})
+	}
+
+	if len(chans) == 0 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	ctx := context.Background()
+	uinfo := loadUserInfo(*uid)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANNEL_ID\tNAME\tDESTINATION\tRULE")
+	for _, ch := range chans {
+		rc := &common.RouteContext{
+			ChannelID:   ch.ID,
+			ChannelName: ch.Name,
+			UserID:      *uid,
+			Text:        *text,
+			Private:     ch.IsPrivate || ch.IsMpIM,
+		}
+		if uinfo != nil {
+			if err := uinfo.SetAuthor(ctx, rc); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot resolve user(%s):%v\n", *uid, err)
+				os.Exit(-1)
+			}
+		}
+
+		dests := dispatcher.Dispatch(rc)
+		dest := strings.Join(dests, ",")
+		if dest == "" {
+			dest = "-"
+		}
+
+		rule := strings.Join(dispatcher.Explain(rc), " ")
+		if rule == "" {
+			rule = "(no rule matched)"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", ch.ID, ch.Name, dest, rule)
+	}
+	w.Flush()
+}
+
+// loadUserInfo resolves the profile and user groups of the author through the API.
+// without SLACK_BOT_TOKEN, only the users rules are evaluated.
+func loadUserInfo(uid string) *common.UserInfo {
+	if uid == "" {
+		return nil
+	}
+
+	token := os.Getenv("SLACK_BOT_TOKEN")
+	if token == "" {
+		fmt.Fprintln(os.Stderr, "[WARN] SLACK_BOT_TOKEN is not set. rules other than users do not match the author.")
+		return nil
+	}
+	return common.CreateUserInfo(slack.New(token), nil, common.NewTeamInfoClient(token, nil))
+}
+
+func loadDispatcher(useRedis bool) (common.ChannelDispatcher, error) {
+	if !useRedis {
+		return common.NewDispatcher()
+	}
+
+	opt := common.LoadRedisConfig()
+	if opt == nil {
+		return nil, errors.New("cannot load redis config")
+	}
+
+	return common.NewSharedDispatcher(context.Background(), redis.NewClient(opt))
+}
+
+// loadChannelList reads the response of conversations.list or an array of channels.
+func loadChannelList(path string) ([]slack.Channel, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var chans []slack.Channel
+		if err := json.Unmarshal(data, &chans); err != nil {
+			return nil, fmt.Errorf("JSON unmarshal error:%w", err)
+		}
+		return chans, nil
+	}
+
+	var resp struct {
+		Channels []slack.Channel `json:"channels"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("JSON unmarshal error:%w", err)
+	}
+	return resp.Channels, nil
+}
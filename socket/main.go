@@ -7,6 +7,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/slack-go/slack"
@@ -58,20 +59,30 @@ func main() {
 		os.Exit(-1)
 	}
 
-	dispatcher, err := common.NewDispatcher()
-	if err != nil {
-		fmt.Printf("cannot load dispatch info:%v", err)
-		os.Exit(-1)
-	}
-	fmt.Println(dispatcher.Rules())
-
 	ctx := context.Background()
 	chinfo := &common.ChannelInfo{}
 	uinfo := &common.UserInfo{}
+	teamInfo := common.NewTeamInfoClient(os.Getenv("SLACK_BOT_TOKEN"), nil)
 
+	var rdb *redis.Client
 	redis_opt := common.LoadRedisConfig()
+	if redis_opt != nil {
+		rdb = redis.NewClient(redis_opt)
+	}
+
+	var dispatcher common.ChannelDispatcher
+	if rdb != nil {
+		dispatcher, err = common.NewSharedDispatcher(ctx, rdb)
+	} else {
+		dispatcher, err = common.NewDispatcher()
+	}
+	if err != nil {
+		fmt.Printf("cannot load dispatch info:%v", err)
+		os.Exit(-1)
+	}
+	fmt.Println(dispatcher.Rules())
 
-	if redis_opt == nil {
+	if rdb == nil {
 		wg := &sync.WaitGroup{}
 		wg.Add(1)
 		go func() {
@@ -86,7 +97,7 @@ func main() {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			uinfo, err = common.InitUserInfo(ctx, api)
+			uinfo, err = common.InitUserInfo(ctx, api, teamInfo)
 			if err != nil {
 				fmt.Printf("cannot init user info:%v\n", err)
 				os.Exit(-1)
@@ -94,10 +105,26 @@ func main() {
 		}()
 		wg.Wait()
 	} else {
-		redis := redis.NewClient(redis_opt)
-		uinfo = common.CreateUserInfo(api, redis)
-		chinfo, _ = common.CreateChanInfo(context.TODO(), api, redis)
+		uinfo = common.CreateUserInfo(api, rdb, teamInfo)
+		chinfo, _ = common.CreateChanInfo(context.TODO(), api, rdb)
+	}
+
+	agg := &common.Aggregator{
+		API:         api,
+		ChannelInfo: chinfo,
+		UserInfo:    uinfo,
+		Dispatcher:  dispatcher,
+		Mirrors:     common.NewMirrorStore(rdb),
+		Outbox:      common.NewOutbox(rdb),
+		DeadLetters: common.NewDeadLetterStore(rdb),
+		Dedup:       common.NewDeduplicator(rdb),
+		Digests:     common.NewDigestStore(rdb),
 	}
+	agg.Start(ctx)
+
+	// events of a channel are processed in order.
+	pool := common.NewKeyedWorkerPool(common.DefaultEventWorkers)
+	go pool.LogDepth(ctx, time.Minute)
 
 	go func() {
 		for evt := range client.Events {
@@ -119,13 +146,12 @@ func main() {
 				client.Ack(*evt.Request)
 				switch eventsAPIEvent.Type {
 				case slackevents.CallbackEvent:
-					go func() {
-						err := common.CallbackEventHandler(context.TODO(), api, eventsAPIEvent, chinfo, uinfo,
-							dispatcher.Dispatch)
+					pool.Submit(common.EventKey(eventsAPIEvent), func() {
+						err := agg.CallbackEventHandler(context.TODO(), eventsAPIEvent)
 						if err != nil {
 							fmt.Fprintf(os.Stderr, "Error!:%+v\n", err)
 						}
-					}()
+					})
 				default:
 					fmt.Printf("unsupported Events API event received: %s\n", eventsAPIEvent.Type)
 				}
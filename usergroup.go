@@ -0,0 +1,131 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// user group members are not notified by events. refresh them periodically.
+const userGroupMembersTTL = 10 * time.Minute
+
+type userGroupMembers struct {
+	members map[string]bool
+	expire  time.Time
+}
+
+// userGroupHandles maps user group IDs to their handles.
+type userGroupHandles struct {
+	handles map[string]string
+	expire  time.Time
+}
+
+// IsUserGroupMember reports whether the user belongs to the user group.
+// SetAuthor fills the profile and user groups of rc.UserID used by dispatch rules.
+func (info *UserInfo) SetAuthor(ctx context.Context, rc *RouteContext) error {
+	prof, err := info.GetUserProfile(ctx, rc.UserID)
+	if err != nil {
+		return err
+	}
+	rc.Profile = prof
+	rc.inUserGroup = info.userGroupMatcher(ctx, rc.UserID)
+	return nil
+}
+
+// userGroupMatcher reports whether the user is a member of the group. errors are logged as not a member.
+func (info *UserInfo) userGroupMatcher(ctx context.Context, uid string) func(gid string) bool {
+	return func(gid string) bool {
+		ok, err := info.IsUserGroupMember(ctx, gid, uid)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot resolve usergroup:%v\n", err)
+		}
+		return ok
+	}
+}
+
+func (info *UserInfo) IsUserGroupMember(ctx context.Context, gid, uid string) (bool, error) {
+	if members, ok := info.lookupUserGroup(gid); ok {
+		return members[uid], nil
+	}
+
+	uids, err := info.api.GetUserGroupMembersContext(ctx, gid)
+	if err != nil {
+		return false, fmt.Errorf("err at usergroups.users.list(gid=%s):%w", gid, err)
+	}
+
+	members := make(map[string]bool)
+	for _, v := range uids {
+		members[v] = true
+	}
+
+	func() {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		info.groups[gid] = &userGroupMembers{members: members, expire: time.Now().Add(userGroupMembersTTL)}
+	}()
+
+	return members[uid], nil
+}
+
+func (info *UserInfo) lookupUserGroup(gid string) (map[string]bool, bool) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	group, ok := info.groups[gid]
+	if !ok || time.Now().After(group.expire) {
+		return nil, false
+	}
+	return group.members, true
+}
+
+// GetUserGroupHandle returns the handle(without @) of the user group.
+func (info *UserInfo) GetUserGroupHandle(ctx context.Context, gid string) (string, error) {
+	if handles, ok := info.lookupUserGroupHandles(); ok {
+		if handle, ok := handles[gid]; ok {
+			return userGroupHandle(gid, handle)
+		}
+		// created after the last refresh?
+	}
+
+	groups, err := info.api.GetUserGroupsContext(ctx, slack.GetUserGroupsOptionIncludeDisabled(true))
+	if err != nil {
+		return "", fmt.Errorf("err at usergroups.list:%w", err)
+	}
+
+	handles := make(map[string]string)
+	for _, v := range groups {
+		handles[v.ID] = v.Handle
+	}
+	// remember unknown groups(e.g. of other organizations) until the next refresh.
+	if _, ok := handles[gid]; !ok {
+		handles[gid] = ""
+	}
+
+	func() {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		info.handles = &userGroupHandles{handles: handles, expire: time.Now().Add(userGroupMembersTTL)}
+	}()
+
+	return userGroupHandle(gid, handles[gid])
+}
+
+func userGroupHandle(gid, handle string) (string, error) {
+	if handle == "" {
+		return "", fmt.Errorf("usergroup not found(gid=%s)", gid)
+	}
+	return handle, nil
+}
+
+func (info *UserInfo) lookupUserGroupHandles() (map[string]string, bool) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	if info.handles == nil || time.Now().After(info.handles.expire) {
+		return nil, false
+	}
+	return info.handles.handles, true
+}
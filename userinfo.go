@@ -10,13 +10,22 @@ import (
 
 	"github.com/go-redis/redis/v8"
 	"github.com/slack-go/slack"
+	"github.com/walkure/aggrechans/mrkdwn"
 )
 
 type UserInfo struct {
-	name  map[string]*UserProfile
-	api   *slack.Client
-	mu    sync.Mutex
-	redis *redis.Client
+	name   map[string]*UserProfile
+	groups map[string]*userGroupMembers
+	// user group handles
+	handles *userGroupHandles
+	// names of external teams
+	teams map[string]string
+	home  *homeTeam
+	// looks up names of external teams. team IDs are shown if nil
+	teamInfo *TeamInfoClient
+	api      *slack.Client
+	mu       sync.Mutex
+	redis    *redis.Client
 }
 
 type UserProfile struct {
@@ -24,19 +33,32 @@ type UserProfile struct {
 	Avatar string `json:"avatar"`
 	Bot    bool   `json:"bot"`
 	App    bool   `json:"app"`
+
+	// used by dispatch rules
+	RealName    string `json:"real_name,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	Title       string `json:"title,omitempty"`
+	TeamID      string `json:"team_id,omitempty"`
+
+	// Slack Connect users, or users of another organization of Enterprise Grid
+	External bool   `json:"external,omitempty"`
+	Org      string `json:"org,omitempty"`
 }
 
-func CreateUserInfo(api *slack.Client, redis *redis.Client) *UserInfo {
+func CreateUserInfo(api *slack.Client, redis *redis.Client, teamInfo *TeamInfoClient) *UserInfo {
 	info := UserInfo{}
 	info.name = make(map[string]*UserProfile)
+	info.groups = make(map[string]*userGroupMembers)
+	info.teams = make(map[string]string)
 	info.api = api
 	info.redis = redis
+	info.teamInfo = teamInfo
 
 	return &info
 }
 
-func InitUserInfo(ctx context.Context, api *slack.Client) (*UserInfo, error) {
-	info := CreateUserInfo(api, nil)
+func InitUserInfo(ctx context.Context, api *slack.Client, teamInfo *TeamInfoClient) (*UserInfo, error) {
+	info := CreateUserInfo(api, nil, teamInfo)
 
 	users, err := api.GetUsersContext(ctx)
 	if err != nil {
@@ -55,6 +77,33 @@ func (prof *UserProfile) IsBots() bool {
 	return prof.Bot || prof.App
 }
 
+// Label is the name shown in mirrored messages. external users are labeled with their organization.
+func (prof *UserProfile) Label() string {
+	if prof.External && prof.Org != "" {
+		return fmt.Sprintf("%s (%s)", prof.Name, prof.Org)
+	}
+	return prof.Name
+}
+
+// field returns the profile field value by the name used in dispatch rules.
+func (prof *UserProfile) field(name string) (string, bool) {
+	switch name {
+	case "name":
+		return prof.Name, true
+	case "real_name":
+		return prof.RealName, true
+	case "display_name":
+		return prof.DisplayName, true
+	case "title":
+		return prof.Title, true
+	case "team":
+		return prof.TeamID, true
+	case "org":
+		return prof.Org, true
+	}
+	return "", false
+}
+
 func (info *UserInfo) GetUserProfile(ctx context.Context, uid string) (*UserProfile, error) {
 	if prof, ok := info.lookupUserInfo(ctx, uid); ok {
 		return prof, nil
@@ -122,11 +171,16 @@ func (up UserProfile) MarshalBinary() ([]byte, error) {
 
 func (info *UserInfo) setUserInfo(ctx context.Context, user *slack.User) *UserProfile {
 	prof := &UserProfile{
-		Name:   user.Name,
-		Avatar: user.Profile.Image72,
-		Bot:    user.IsBot || user.ID == "USLACKBOT",
-		App:    user.IsAppUser,
+		Name:        user.Name,
+		Avatar:      user.Profile.Image72,
+		Bot:         user.IsBot || user.ID == "USLACKBOT",
+		App:         user.IsAppUser,
+		RealName:    user.Profile.RealName,
+		DisplayName: user.Profile.DisplayName,
+		Title:       user.Profile.Title,
+		TeamID:      user.TeamID,
 	}
+	info.setExternal(ctx, prof, user.IsStranger, user.Enterprise.EnterpriseID, user.Enterprise.EnterpriseName)
 
 	func() {
 		info.mu.Lock()
@@ -174,44 +228,33 @@ func (info *UserInfo) ReplaceMentionUIDs(ctx context.Context, orig string) (stri
 
 	uids := extractUids(orig)
 
-	oldnews := []string{}
+	names := map[string]string{}
 	for _, uid := range uids {
-		prof, err := info.GetUserProfile(ctx, uid)
-		if err != nil {
-			return "", fmt.Errorf("error replacing uids:%w", err)
+		name := uid
+		// users of other organizations may be invisible. neutralize the mention anyway.
+		if prof, err := info.GetUserProfile(ctx, uid); err == nil {
+			name = prof.Name
+		} else {
+			fmt.Fprintf(os.Stderr, "error replacing uids:%v\n", err)
 		}
-		oldnews = append(oldnews, "<@"+uid+">", "<＠"+prof.Name+">")
+		names[uid] = name
 	}
 
-	reps := strings.NewReplacer(oldnews...)
-	return reps.Replace(orig), nil
+	return rewriteText(orig, func(tok mrkdwn.Token) (string, bool) {
+		if name, ok := names[tok.Value]; ok && tok.Kind == mrkdwn.UserRef {
+			return "<＠" + name + ">", true
+		}
+		return "", false
+	}), nil
 }
 
 func extractUids(msg string) []string {
-	msgRune := []rune(msg)
-
 	uids := []string{}
-	tag := 0
-	for i := 0; i < len(msgRune); i++ {
-		if msgRune[i] == '<' {
-			tag = 1
-		} else if msgRune[i] == '@' && tag == 1 {
-			tag = 2
-		} else if msgRune[i] == 'U' && tag == 2 {
-			sb := strings.Builder{}
-			for j := i; j < len(msgRune); j++ {
-				if msgRune[j] == '>' {
-					uids = append(uids, sb.String())
-					i = j
-					break
-				} else {
-					sb.WriteRune(msgRune[j])
-				}
-			}
-			tag = 0
-		} else {
-			tag = 0
+	rewriteText(msg, func(tok mrkdwn.Token) (string, bool) {
+		if tok.Kind == mrkdwn.UserRef && (strings.HasPrefix(tok.Value, "U") || strings.HasPrefix(tok.Value, "W")) {
+			uids = append(uids, tok.Value)
 		}
-	}
+		return "", false
+	})
 	return uids
 }
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractUids(t *testing.T) {
+	assert.Equal(t, []string{"U123", "W456"}, extractUids("hi <@U123> and <@W456>, not <#C789>"))
+}
+
+func TestExternalProfile(t *testing.T) {
+	ctx := context.Background()
+	ui := CreateUserInfo(nil, nil, nil)
+	ui.home = &homeTeam{teamId: "THOME", enterpriseId: "EHOME"}
+	ui.teams["TPARTNER"] = "Partner Inc."
+
+	prof := &UserProfile{Name: "alice", TeamID: "TPARTNER"}
+	ui.setExternal(ctx, prof, false, "", "")
+	assert.True(t, prof.External)
+	assert.Equal(t, "alice (Partner Inc.)", prof.Label())
+
+	// another workspace of the same organization
+	prof = &UserProfile{Name: "bob", TeamID: "TSISTER"}
+	ui.setExternal(ctx, prof, false, "EHOME", "Home Org")
+	assert.False(t, prof.External)
+	assert.Equal(t, "bob", prof.Label())
+
+	prof = &UserProfile{Name: "carol", TeamID: "TSISTER"}
+	ui.setExternal(ctx, prof, false, "EOTHER", "Other Org")
+	assert.Equal(t, "carol (Other Org)", prof.Label())
+
+	// invisible users of the home team are not external.
+	assert.False(t, ui.externalProfile(ctx, "UHIDDEN", "THOME").External)
+}
+
+func TestReplaceMentionUIDs(t *testing.T) {
+	ui := CreateUserInfo(nil, nil, nil)
+	ui.name["U1"] = &UserProfile{Name: "alice"}
+	ui.name["W2"] = &UserProfile{Name: "bob"}
+
+	got, err := ui.ReplaceMentionUIDs(context.Background(), "<<@U1> <@W2|bob> <@U1>")
+	assert.Nil(t, err)
+	assert.Equal(t, "<<＠alice> <＠bob> <＠alice>", got)
+}
+
+func TestReplaceMentionUIDsInCode(t *testing.T) {
+	ui := CreateUserInfo(nil, nil, nil)
+	ui.name["U1"] = &UserProfile{Name: "alice"}
+
+	got, err := ui.ReplaceMentionUIDs(context.Background(), "<@U1> `<@U1>` ```<@U1>```")
+	assert.Nil(t, err)
+	assert.Equal(t, "<＠alice> `<@U1>` ```<@U1>```", got)
+}
@@ -54,16 +54,33 @@ func main() {
 		return
 	}
 	redis := redis.NewClient(opt)
-	uinfo := common.CreateUserInfo(api, redis)
+	uinfo := common.CreateUserInfo(api, redis, common.NewTeamInfoClient(os.Getenv("SLACK_BOT_TOKEN"), nil))
 	chinfo, _ := common.CreateChanInfo(ctx, api, redis)
 
-	dispatcher, err := common.NewDispatcher()
+	dispatcher, err := common.NewSharedDispatcher(ctx, redis)
 	if err != nil {
 		fmt.Printf("cannot load dispatch info:%v", err)
 		os.Exit(-1)
 	}
 	fmt.Println(dispatcher.Rules())
 
+	agg := &common.Aggregator{
+		API:         api,
+		ChannelInfo: chinfo,
+		UserInfo:    uinfo,
+		Dispatcher:  dispatcher,
+		Mirrors:     common.NewMirrorStore(redis),
+		Outbox:      common.NewOutbox(redis),
+		DeadLetters: common.NewDeadLetterStore(redis),
+		Dedup:       common.NewDeduplicator(redis),
+		Digests:     common.NewDigestStore(redis),
+	}
+	agg.Start(ctx)
+
+	// events of a channel are processed in order.
+	pool := common.NewKeyedWorkerPool(common.DefaultEventWorkers)
+	go pool.LogDepth(ctx, time.Minute)
+
 	http.HandleFunc("/events-endpoint", func(w http.ResponseWriter, r *http.Request) {
 		body, err := loadRequest(w, r, signingSecret)
 		if err != nil {
@@ -86,12 +103,12 @@ func main() {
 			w.Header().Set("Content-Type", "text")
 			w.Write([]byte(r.Challenge))
 		case slackevents.CallbackEvent:
-			go func() {
-				err := common.CallbackEventHandler(context.Background(), api, eventsAPIEvent, chinfo, uinfo, dispatcher.Dispatch)
+			pool.Submit(common.EventKey(eventsAPIEvent), func() {
+				err := agg.CallbackEventHandler(context.Background(), eventsAPIEvent)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Error!:%+v\n", err)
 				}
-			}()
+			})
 		}
 
 	})
@@ -0,0 +1,114 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack/slackevents"
+)
+
+// DefaultEventWorkers is the number of events processed at once.
+const DefaultEventWorkers = 16
+
+// KeyedWorkerPool runs jobs of the same key in the submitted order,
+// and jobs of different keys in parallel.
+type KeyedWorkerPool struct {
+	queues map[string][]func()
+	mu     sync.Mutex
+	// limits jobs running at once
+	sem chan struct{}
+}
+
+func NewKeyedWorkerPool(workers int) *KeyedWorkerPool {
+	return &KeyedWorkerPool{
+		queues: make(map[string][]func()),
+		sem:    make(chan struct{}, workers),
+	}
+}
+
+// Submit queues the job. it never blocks.
+func (p *KeyedWorkerPool) Submit(key string, job func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	q, running := p.queues[key]
+	p.queues[key] = append(q, job)
+	if !running {
+		go p.work(key)
+	}
+}
+
+// work runs jobs of the key until the queue becomes empty.
+func (p *KeyedWorkerPool) work(key string) {
+	for {
+		var job func()
+		func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			job = p.queues[key][0]
+		}()
+
+		p.sem <- struct{}{}
+		job()
+		<-p.sem
+
+		done := false
+		func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			q := p.queues[key][1:]
+			if len(q) == 0 {
+				delete(p.queues, key)
+				done = true
+			} else {
+				p.queues[key] = q
+			}
+		}()
+
+		if done {
+			return
+		}
+	}
+}
+
+// Depth returns the number of queued(including running) jobs per key.
+func (p *KeyedWorkerPool) Depth() map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	depth := make(map[string]int, len(p.queues))
+	for key, q := range p.queues {
+		depth[key] = len(q)
+	}
+	return depth
+}
+
+// LogDepth prints keys with queued jobs every interval until ctx is done.
+func (p *KeyedWorkerPool) LogDepth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if depth := p.Depth(); len(depth) > 0 {
+			fmt.Printf("queued events:%v\n", depth)
+		}
+	}
+}
+
+// EventKey returns the key to serialize the event, the source channel ID of messages.
+func EventKey(eventsAPIEvent slackevents.EventsAPIEvent) string {
+	switch ev := eventsAPIEvent.InnerEvent.Data.(type) {
+	case *slackevents.MessageEvent:
+		return ev.Channel
+	case *slackevents.ChannelRenameEvent:
+		return ev.Channel.ID
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyedWorkerPool(t *testing.T) {
+	p := NewKeyedWorkerPool(4)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	order := map[string][]int{}
+	block := make(chan struct{})
+
+	// the first job of C1 blocks until C2 finishes.
+	wg.Add(1)
+	p.Submit("C1", func() {
+		defer wg.Done()
+		<-block
+		mu.Lock()
+		defer mu.Unlock()
+		order["C1"] = append(order["C1"], 0)
+	})
+	for i := 1; i < 3; i++ {
+		i := i
+		wg.Add(1)
+		p.Submit("C1", func() {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			order["C1"] = append(order["C1"], i)
+		})
+	}
+	assert.Equal(t, 3, p.Depth()["C1"])
+
+	c2 := make(chan struct{})
+	p.Submit("C2", func() { close(c2) })
+	select {
+	case <-c2:
+	case <-time.After(time.Second):
+		t.Fatal("C2 blocked by C1")
+	}
+
+	close(block)
+	wg.Wait()
+	assert.Equal(t, []int{0, 1, 2}, order["C1"])
+
+	assert.Eventually(t, func() bool { return len(p.Depth()) == 0 }, time.Second, 10*time.Millisecond)
+}